@@ -1,19 +1,266 @@
 package main
 
 import (
+	"bufio"
 	"flag"
+	"fmt"
 	"github.com/Static-Flow/BurpSuiteTeamServer/internal"
+	"io"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "adduser", "removeuser", "resetuser":
+			manageUsers(os.Args[1], os.Args[2:])
+			return
+		case "rotatekey":
+			rotateShortenerKey(os.Args[2:])
+			return
+		case "issuecert", "revokecert", "listcerts":
+			manageCerts(os.Args[1], os.Args[2:])
+			return
+		case "rotate-cert":
+			rotateCert(os.Args[2:])
+			return
+		}
+	}
 	var host = flag.String("host", "localhost", "host for TLS cert. Defaults to localhost")
 	var port = flag.String("port", "9999", "http service address")
 	var serverPassword = flag.String("serverPassword", "", "password for the server")
 	var enableUrlShortener = flag.Bool("enableShortener", false, "Enables the built-in URL shortener")
-	var shortenerPort = flag.String("shortPort", "4444", "Sets the built-in URL shortener port")
+	var shortenerPort = flag.String("shortPort", "", "also serve the built-in URL shortener on this port, it is always served on the main port under /shortener")
+	var shortenerTTL = flag.Duration("shortTTL", 7*24*time.Hour, "how long shortened links last unless a ttl is given when creating them, 0 for no limit")
+	var shortenerIdLength = flag.Int("shortIdLength", 20, "length of the random ids given to shortened links")
+	var shortenerKey = flag.String("shortKey", "", "API key for creating shortened links, the saved key or a generated one is used if empty")
+	var dataDir = flag.String("dataDir", "data", "directory where room history and persistent rooms are stored")
+	var messageRateLimit = flag.Int("rateLimit", 0, "maximum messages per second from each client, 0 for no limit")
+	var compressionThreshold = flag.Int("compressionThreshold", 0, "messages smaller than this many bytes are sent uncompressed")
+	var maxMessageSize = flag.Int64("maxMessageSize", 32<<20, "largest message in bytes accepted from a client, 0 for no limit")
+	var redactionRules = flag.String("redactionRules", "", "JSON file with the default redaction rules, Authorization headers are redacted if empty")
+	var requireClientCerts = flag.Bool("requireClientCerts", false, "refuse clients that don't connect with a certificate from issuecert")
+	var certFile = flag.String("cert", internal.ServerCertFile, "server certificate, optionally followed by the rest of its chain. A self-signed one is generated if it doesn't exist")
+	var keyFile = flag.String("key", internal.ServerKeyFile, "key of the server certificate")
+	var clientCAFile = flag.String("clientCA", "", "CA certificate that client certificates are issued by, -cert if empty")
+	var keyType = flag.String("keyType", internal.KeyTypeRSA, "key type of a generated server certificate, rsa or ecdsa")
+	var tlsMin = flag.String("tlsMin", "1.2", "lowest TLS version clients may use")
+	var tlsMax = flag.String("tlsMax", "1.3", "highest TLS version clients may use")
+	var cipherSuites = flag.String("ciphers", "", "comma separated TLS 1.2 cipher suites to allow, Go's defaults if empty. TLS 1.3 suites can't be configured")
 	flag.Parse()
 
-	internal.StartServer(serverPassword, host, enableUrlShortener, shortenerPort, port)
+	tlsMinVersion, err := internal.ParseTLSVersion(*tlsMin)
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsMaxVersion, err := internal.ParseTLSVersion(*tlsMax)
+	if err != nil {
+		log.Fatal(err)
+	}
+	ciphers, err := internal.ParseCipherSuites(*cipherSuites)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	internal.StartServer(&internal.ServerConfig{
+		ServerPassword:       *serverPassword,
+		Host:                 *host,
+		Port:                 *port,
+		EnableUrlShortener:   *enableUrlShortener,
+		ShortenerPort:        *shortenerPort,
+		ShortenerTTL:         *shortenerTTL,
+		ShortenerIdLength:    *shortenerIdLength,
+		ShortenerApiKey:      *shortenerKey,
+		DataDir:              *dataDir,
+		MessageRateLimit:     *messageRateLimit,
+		CompressionThreshold: *compressionThreshold,
+		MaxMessageSize:       *maxMessageSize,
+		RedactionRulesFile:   *redactionRules,
+		RequireClientCerts:   *requireClientCerts,
+		CertFile:             *certFile,
+		KeyFile:              *keyFile,
+		ClientCAFile:         *clientCAFile,
+		KeyType:              *keyType,
+		TLSMinVersion:        tlsMinVersion,
+		TLSMaxVersion:        tlsMaxVersion,
+		CipherSuites:         ciphers,
+	})
+}
+
+func manageUsers(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	var dataDir = flags.String("dataDir", "data", "directory where the user list is stored")
+	var username = flags.String("name", "", "name of the user")
+	var passwordStdin = flags.Bool("passwordStdin", false, "read the password for the user from stdin, a random one is generated otherwise")
+	_ = flags.Parse(args)
+
+	if len(*username) == 0 {
+		log.Fatalf("%s requires -name", command)
+	}
+	if err := os.MkdirAll(*dataDir, 0700); err != nil {
+		log.Fatalf("could not create data directory: %s", err)
+	}
+	users, err := internal.LoadUserStore(filepath.Join(*dataDir, internal.UsersFileName))
+	if err != nil {
+		log.Fatalf("could not load users: %s", err)
+	}
+	//passwords are never taken as arguments, where they would end up in shell history and the process list
+	var password string
+	generatedPassword := command != "removeuser" && !*passwordStdin
+	if generatedPassword {
+		if password, err = internal.GeneratePassword(); err != nil {
+			log.Fatalf("could not generate password: %s", err)
+		}
+	} else if command != "removeuser" {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			log.Fatalf("could not read password: %s", err)
+		}
+		if password = strings.TrimRight(line, "\r\n"); len(password) == 0 {
+			log.Fatal("the password read from stdin is empty")
+		}
+	}
+
+	switch command {
+	case "adduser":
+		err = users.AddUser(*username, password)
+	case "removeuser":
+		if err = users.RemoveUser(*username); err == nil {
+			err = revokeUserCerts(*dataDir, *username)
+		}
+	case "resetuser":
+		err = users.ResetPassword(*username, password)
+	}
+	if err != nil {
+		log.Fatalf("%s failed: %s", command, err)
+	}
+	log.Printf("%s %s done", command, *username)
+	if generatedPassword {
+		fmt.Printf("generated password for %s: %s\n", *username, password)
+	}
+}
+
+func rotateShortenerKey(args []string) {
+	flags := flag.NewFlagSet("rotatekey", flag.ExitOnError)
+	var dataDir = flags.String("dataDir", "data", "directory where the shortener API key is stored")
+	var key = flags.String("key", "", "new API key, a random one is generated if empty")
+	var admin = flags.Bool("admin", false, "rotate the admin key used to manage links instead of the API key")
+	_ = flags.Parse(args)
+
+	if err := os.MkdirAll(*dataDir, 0700); err != nil {
+		log.Fatalf("could not create data directory: %s", err)
+	}
+	keyName, keyPath := "API key", filepath.Join(*dataDir, internal.ShortenerKeyFileName)
+	if *admin {
+		keyName, keyPath = "admin key", filepath.Join(*dataDir, internal.ShortenerAdminKeyFileName)
+	}
+	var err error
+	if len(*key) == 0 {
+		*key, err = internal.RotateShortenerApiKey(keyPath)
+	} else {
+		err = internal.SaveShortenerApiKey(keyPath, *key)
+	}
+	if err != nil {
+		log.Fatalf("rotatekey failed: %s", err)
+	}
+	fmt.Printf("shortener %s: %s\n", keyName, *key)
+}
+
+func manageCerts(command string, args []string) {
+	flags := flag.NewFlagSet(command, flag.ExitOnError)
+	var dataDir = flags.String("dataDir", "data", "directory where the list of issued certificates is stored")
+	var username = flags.String("name", "", "name of the user")
+	var serial = flags.String("serial", "", "serial number of the certificate to revoke, every certificate of -name is revoked if empty")
+	var validity = flags.Duration("validity", 365*24*time.Hour, "how long an issued certificate is valid for")
+	var outDir = flags.String("out", ".", "directory the issued certificate and key are written to")
+	var caCertFile = flags.String("caCert", internal.ServerCertFile, "CA certificate to issue certificates with")
+	var caKeyFile = flags.String("caKey", internal.ServerKeyFile, "key of the CA certificate")
+	_ = flags.Parse(args)
+
+	if err := os.MkdirAll(*dataDir, 0700); err != nil {
+		log.Fatalf("could not create data directory: %s", err)
+	}
+	clientCerts, err := internal.LoadClientCertStore(filepath.Join(*dataDir, internal.ClientCertsFileName))
+	if err != nil {
+		log.Fatalf("could not load client certificates: %s", err)
+	}
+	switch command {
+	case "issuecert":
+		if len(*username) == 0 {
+			log.Fatalf("%s requires -name", command)
+		}
+		issued, certPEM, keyPEM, err := clientCerts.Issue(*caCertFile, *caKeyFile, *username, *validity)
+		if err != nil {
+			log.Fatalf("%s failed: %s", command, err)
+		}
+		certPath := filepath.Join(*outDir, *username+".pem")
+		keyPath := filepath.Join(*outDir, *username+".key")
+		if err := ioutil.WriteFile(certPath, certPEM, 0644); err != nil {
+			log.Fatalf("could not write %s: %s", certPath, err)
+		}
+		if err := ioutil.WriteFile(keyPath, keyPEM, 0600); err != nil {
+			log.Fatalf("could not write %s: %s", keyPath, err)
+		}
+		fmt.Printf("issued certificate %s to %s, valid until %s: %s %s\n", issued.Serial, issued.Username, issued.Expires.Format(time.RFC3339), certPath, keyPath)
+	case "revokecert":
+		if len(*username) == 0 && len(*serial) == 0 {
+			log.Fatalf("%s requires -name or -serial", command)
+		}
+		revoked, err := clientCerts.Revoke(*username, *serial)
+		if err != nil {
+			log.Fatalf("%s failed: %s", command, err)
+		}
+		fmt.Printf("revoked %d certificates\n", revoked)
+	case "listcerts":
+		certs, err := clientCerts.List()
+		if err != nil {
+			log.Fatalf("%s failed: %s", command, err)
+		}
+		for _, cert := range certs {
+			status := "valid"
+			if !cert.Revoked.IsZero() {
+				status = "revoked " + cert.Revoked.Format(time.RFC3339)
+			} else if time.Now().After(cert.Expires) {
+				status = "expired"
+			}
+			fmt.Printf("%s\t%s\texpires %s\t%s\n", cert.Serial, cert.Username, cert.Expires.Format(time.RFC3339), status)
+		}
+	}
+}
+
+// a removed user's certificates shouldn't keep letting them in
+func revokeUserCerts(dataDir string, username string) error {
+	clientCerts, err := internal.LoadClientCertStore(filepath.Join(dataDir, internal.ClientCertsFileName))
+	if err != nil {
+		return err
+	}
+	revoked, err := clientCerts.Revoke(username, "")
+	if revoked > 0 {
+		log.Printf("revoked %d certificates of %s", revoked, username)
+	}
+	return err
+}
+
+func rotateCert(args []string) {
+	flags := flag.NewFlagSet("rotate-cert", flag.ExitOnError)
+	var certFile = flags.String("cert", internal.ServerCertFile, "server certificate to renew")
+	var keyFile = flags.String("key", internal.ServerKeyFile, "key of the server certificate")
+	var host = flags.String("host", "", "hosts for the new certificate, the old certificate's hosts are kept if empty")
+	var validity = flags.Duration("validity", 365*24*time.Hour, "how long the new certificate is valid for")
+	var newKey = flags.Bool("newKey", false, "generate a new key too, client certificates must then be issued again")
+	var keyType = flags.String("keyType", "", "type of the new key, rsa or ecdsa. The old key's type is kept if empty")
+	_ = flags.Parse(args)
+
+	cert, err := internal.RotateCert(*host, *certFile, *keyFile, *validity, *newKey, *keyType)
+	if err != nil {
+		log.Fatalf("rotate-cert failed: %s", err)
+	}
+	fmt.Printf("renewed %s, valid until %s. A running server uses it for new connections straight away, hand the new file to clients so they trust it\n", *certFile, cert.NotAfter.Format(time.RFC3339))
+	fmt.Printf("SHA-256 fingerprint: %s\n", internal.CertFingerprint(cert))
 }
@@ -11,4 +11,8 @@ require (
 	github.com/lesismal/nbio v1.2.1 // indirect
 	github.com/pkg/profile v1.6.0 // indirect
 	github.com/valyala/fasthttp v1.34.0
+	github.com/vmihailenco/msgpack/v5 v5.3.5
+	github.com/vmihailenco/tagparser/v2 v2.0.0 // indirect
+	go.etcd.io/bbolt v1.3.6
+	golang.org/x/crypto v0.0.0-20220214200702-86341886e292
 )
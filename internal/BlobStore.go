@@ -0,0 +1,167 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+// BlobStore keeps request and response bodies on disk named by the SHA-256 of their contents, so a body shared
+// many times is only stored once. Every room has its own store, so members can only fetch bodies shared in their
+// room and the bodies go when the room does
+type BlobStore struct {
+	directory string
+}
+
+func NewBlobStore(directory string) (*BlobStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &BlobStore{directory: directory}, nil
+}
+
+// the store for one room's bodies, nil if the server doesn't keep blobs
+func (b *BlobStore) forRoom(roomName string) *BlobStore {
+	if b == nil {
+		return nil
+	}
+	return &BlobStore{directory: filepath.Join(b.directory, hex.EncodeToString([]byte(roomName)))}
+}
+
+func (b *BlobStore) RemoveRoom(roomName string) {
+	if err := os.RemoveAll(b.forRoom(roomName).directory); err != nil {
+		log.Printf("could not remove blobs of room %s: %s", roomName, err)
+	}
+}
+
+// removes the blobs of every room but the given ones, which is how rooms from an earlier run are cleaned up
+func (b *BlobStore) RemoveAllRoomsExcept(roomNames []string) {
+	keep := make(map[string]bool)
+	for _, roomName := range roomNames {
+		keep[roomName] = true
+	}
+	files, err := ioutil.ReadDir(b.directory)
+	if err != nil {
+		log.Printf("could not list blobs: %s", err)
+		return
+	}
+	for _, file := range files {
+		roomName, err := hex.DecodeString(file.Name())
+		if err != nil || keep[string(roomName)] {
+			continue
+		}
+		log.Printf("removing blobs of room %s from an earlier run", roomName)
+		b.RemoveRoom(string(roomName))
+	}
+}
+
+func isBlobHash(hash string) bool {
+	if len(hash) != sha256.Size*2 {
+		return false
+	}
+	_, err := hex.DecodeString(hash)
+	return err == nil
+}
+
+// blobs are spread over subdirectories by the first byte of their hash to keep directories small
+func (b *BlobStore) blobPath(hash string) string {
+	return filepath.Join(b.directory, hash[:2], hash)
+}
+
+func (b *BlobStore) Put(data []byte) (string, error) {
+	hashBytes := sha256.Sum256(data)
+	hash := hex.EncodeToString(hashBytes[:])
+	if b.Has(hash) {
+		return hash, nil
+	}
+	if err := os.MkdirAll(filepath.Dir(b.blobPath(hash)), 0700); err != nil {
+		return "", err
+	}
+	//write to a temporary file first so a blob is either complete or missing, never half written
+	tempFile, err := ioutil.TempFile(filepath.Dir(b.blobPath(hash)), hash+".tmp")
+	if err != nil {
+		return "", err
+	}
+	if _, err := tempFile.Write(data); err != nil {
+		_ = tempFile.Close()
+		_ = os.Remove(tempFile.Name())
+		return "", err
+	}
+	if err := tempFile.Close(); err != nil {
+		_ = os.Remove(tempFile.Name())
+		return "", err
+	}
+	return hash, os.Rename(tempFile.Name(), b.blobPath(hash))
+}
+
+func (b *BlobStore) Has(hash string) bool {
+	if b == nil || !isBlobHash(hash) {
+		return false
+	}
+	_, err := os.Stat(b.blobPath(hash))
+	return err == nil
+}
+
+func (b *BlobStore) Get(hash string) ([]byte, error) {
+	if b == nil || !isBlobHash(hash) {
+		return nil, os.ErrNotExist
+	}
+	return ioutil.ReadFile(b.blobPath(hash))
+}
+
+// returns the body along with its hash, storing bodies that were sent inline and loading ones that were only referenced
+func (b *BlobStore) internBody(body BurpBytes, hash string) (BurpBytes, string, error) {
+	if len(body) > 0 {
+		hash, err := b.Put(body)
+		return body, hash, err
+	}
+	body, err := b.loadBody(body, hash)
+	if len(body) == 0 {
+		return nil, "", err
+	}
+	return body, hash, err
+}
+
+// returns the body, loading it from the store if it was only referenced by hash. A nil store has no blobs to load
+func (b *BlobStore) loadBody(body BurpBytes, hash string) (BurpBytes, error) {
+	if len(body) > 0 || len(hash) == 0 {
+		return body, nil
+	}
+	body, err := b.Get(hash)
+	if os.IsNotExist(err) {
+		return nil, newClientError(ErrorBlobNotFound, "blob %s does not exist", hash)
+	}
+	return body, err
+}
+
+// returns the request in the two forms it is sent in, one referring to its bodies by hash and one carrying them inline
+func (b *BlobStore) internBodies(burpReqResp *BurpRequestResponse) (*BurpRequestResponse, *BurpRequestResponse, error) {
+	inline := *burpReqResp
+	var err error
+	if inline.Request, inline.RequestHash, err = b.internBody(burpReqResp.Request, burpReqResp.RequestHash); err != nil {
+		return nil, nil, err
+	}
+	if inline.Response, inline.ResponseHash, err = b.internBody(burpReqResp.Response, burpReqResp.ResponseHash); err != nil {
+		return nil, nil, err
+	}
+	referenced := inline
+	referenced.Request = nil
+	referenced.Response = nil
+	return &referenced, &inline, nil
+}
+
+// returns a copy of the request carrying its bodies inline, without storing anything
+func (b *BlobStore) loadBodies(burpReqResp *BurpRequestResponse) (*BurpRequestResponse, error) {
+	inline := *burpReqResp
+	var err error
+	if inline.Request, err = b.loadBody(burpReqResp.Request, burpReqResp.RequestHash); err != nil {
+		return nil, err
+	}
+	if inline.Response, err = b.loadBody(burpReqResp.Response, burpReqResp.ResponseHash); err != nil {
+		return nil, err
+	}
+	return &inline, nil
+}
@@ -1,11 +1,54 @@
 package internal
 
 import (
+	"encoding/json"
 	"fmt"
+	"github.com/vmihailenco/msgpack/v5"
+	"strconv"
 	"strings"
 	"time"
 )
 
+// BurpBytes holds raw request and response bytes. Legacy JSON clients send and expect Java's signed bytes as
+// an array of numbers, while the v2 wire format sends them as msgpack binary
+type BurpBytes []byte
+
+func (b BurpBytes) MarshalJSON() ([]byte, error) {
+	if b == nil {
+		return []byte("null"), nil
+	}
+	jsonBytes := make([]byte, 0, len(b)*4+2)
+	jsonBytes = append(jsonBytes, '[')
+	for i, burpByte := range b {
+		if i > 0 {
+			jsonBytes = append(jsonBytes, ',')
+		}
+		jsonBytes = strconv.AppendInt(jsonBytes, int64(int8(burpByte)), 10)
+	}
+	return append(jsonBytes, ']'), nil
+}
+
+func (b *BurpBytes) UnmarshalJSON(data []byte) error {
+	var ints []int
+	if err := json.Unmarshal(data, &ints); err != nil {
+		return err
+	}
+	if ints == nil {
+		*b = nil
+		return nil
+	}
+	burpBytes := make(BurpBytes, len(ints))
+	for i, value := range ints {
+		//accept both Java's signed bytes and unsigned ones
+		if value < -128 || value > 255 {
+			return fmt.Errorf("%d is not a byte", value)
+		}
+		burpBytes[i] = byte(value)
+	}
+	*b = burpBytes
+	return nil
+}
+
 type JavaJsonTime struct {
 	T time.Time
 }
@@ -28,7 +71,26 @@ func (j JavaJsonTime) MarshalJSON() ([]byte, error) {
 	return []byte(`"` + j.T.Format("Jan _2 15:04:05") + `"`), nil
 }
 
+// the v2 wire format keeps the same time format as the JSON one
+func (j JavaJsonTime) EncodeMsgpack(enc *msgpack.Encoder) error {
+	return enc.EncodeString(j.String())
+}
+
+func (j *JavaJsonTime) DecodeMsgpack(dec *msgpack.Decoder) error {
+	s, err := dec.DecodeString()
+	if err != nil {
+		return err
+	}
+	t, err := time.Parse("Jan _2 15:04:05", s)
+	if err != nil {
+		return err
+	}
+	*j = JavaJsonTime{t}
+	return nil
+}
+
 type Comment struct {
+	Id               string       `json:"id"`
 	Comment          string       `json:"comment"`
 	UserWhoCommented string       `json:"userWhoCommented"`
 	TimeOfComment    JavaJsonTime `json:"timeOfComment"`
@@ -41,16 +103,23 @@ type BurpMetaData struct {
 }
 
 type BurpRequestResponse struct {
-	Request     []int         `json:"request"`
-	Response    []int         `json:"response"`
+	Request     BurpBytes     `json:"request"`
+	Response    BurpBytes     `json:"response"`
 	HttpService *BurpMetaData `json:"httpService"`
 	Comments    []Comment     `json:"comments"`
+	//SHA-256 of the bodies in the server's blob store, clients can send these instead of bodies the server already has
+	RequestHash  string `json:"requestHash,omitempty"`
+	ResponseHash string `json:"responseHash,omitempty"`
 }
 
 type BurpTCMessage struct {
 	BurpRequestResponse *BurpRequestResponse `json:"burpmsg"`
 	MessageType         string               `json:"msgtype"`
 	Data                string               `json:"data"`
+	//contents of a blob in BLOB_MESSAGE replies
+	Blob BurpBytes `json:"blob,omitempty"`
+	//set on a COOKIE_MESSAGE to share its cookies without the room's redaction rules
+	NoRedact bool `json:"noRedact,omitempty"`
 }
 
 func NewBurpTCMessage() *BurpTCMessage {
@@ -62,18 +131,36 @@ func (b BurpTCMessage) String() string {
 		b.BurpRequestResponse, b.MessageType, b.Data)
 }
 
-func (b BurpRequestResponse) addComment(comment Comment) {
+func (b *BurpRequestResponse) addComment(comment Comment) {
 	b.Comments = append(b.Comments, comment)
 }
 
-func (b BurpRequestResponse) removeComments() {
+func (b *BurpRequestResponse) removeComments() {
 	b.Comments = nil
 }
 
-func (b BurpRequestResponse) setComments(comments []Comment) {
+func (b *BurpRequestResponse) setComments(comments []Comment) {
 	b.Comments = append([]Comment(nil), comments...)
 }
 
+func (b *BurpRequestResponse) getComment(id string) *Comment {
+	for i := range b.Comments {
+		if b.Comments[i].Id == id {
+			return &b.Comments[i]
+		}
+	}
+	return nil
+}
+
+func (b *BurpRequestResponse) removeComment(id string) {
+	for i := range b.Comments {
+		if b.Comments[i].Id == id {
+			b.Comments = append(b.Comments[:i], b.Comments[i+1:]...)
+			return
+		}
+	}
+}
+
 func (b BurpRequestResponse) String() string {
 	return fmt.Sprintf("%+q - %+q - %+v - %+v", b.Request, b.Response, b.HttpService, b.Comments)
 }
@@ -0,0 +1,149 @@
+package internal
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	//certificates expiring sooner than this are warned about in the log
+	certExpiryWarning = 30 * 24 * time.Hour
+	certExpiryCheck   = 12 * time.Hour
+)
+
+// certReloader serves the server certificate and client CA from disk, loading them again whenever the files change
+// so a renewed certificate is used for new connections without a restart. Connected clients keep their connection
+type certReloader struct {
+	certFile     string
+	keyFile      string
+	clientCAFile string
+	lock         sync.Mutex
+	cert         *tls.Certificate
+	leaf         *x509.Certificate
+	clientCAs    *x509.CertPool
+	clientCA     *x509.Certificate
+	modified     map[string]time.Time
+}
+
+func newCertReloader(certFile string, keyFile string, clientCAFile string) (*certReloader, error) {
+	reloader := &certReloader{
+		certFile:     certFile,
+		keyFile:      keyFile,
+		clientCAFile: clientCAFile,
+		modified:     make(map[string]time.Time),
+	}
+	reloader.lock.Lock()
+	defer reloader.lock.Unlock()
+	if _, err := reloader.reload(); err != nil {
+		return nil, err
+	}
+	if !reloader.clientCA.IsCA {
+		log.Printf("%s is not a CA certificate, client certificates can't be checked without -clientCA", clientCAFile)
+	}
+	//teammates compare this with what their client shows, or pin it
+	log.Printf("server certificate SHA-256 fingerprint: %s", CertFingerprint(reloader.leaf))
+	reloader.checkExpiry()
+	return reloader, nil
+}
+
+// loads the files again if any of them changed, returning whether they did. Must hold the lock
+func (c *certReloader) reload() (bool, error) {
+	changed := false
+	modified := make(map[string]time.Time)
+	for _, path := range []string{c.certFile, c.keyFile, c.clientCAFile} {
+		fileInfo, err := os.Stat(path)
+		if err != nil {
+			return false, err
+		}
+		modified[path] = fileInfo.ModTime()
+		changed = changed || !fileInfo.ModTime().Equal(c.modified[path])
+	}
+	if !changed {
+		return false, nil
+	}
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return false, err
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		return false, err
+	}
+	clientCAPEM, err := ioutil.ReadFile(c.clientCAFile)
+	if err != nil {
+		return false, err
+	}
+	clientCAs := x509.NewCertPool()
+	clientCAs.AppendCertsFromPEM(clientCAPEM)
+	//the first certificate in the file is the CA, the rest of a chain may follow it
+	clientCABlock, _ := pem.Decode(clientCAPEM)
+	if clientCABlock == nil || clientCABlock.Type != "CERTIFICATE" {
+		return false, errors.New(c.clientCAFile + " does not start with a PEM encoded certificate")
+	}
+	clientCA, err := x509.ParseCertificate(clientCABlock.Bytes)
+	if err != nil {
+		return false, err
+	}
+	c.cert, c.leaf, c.clientCAs, c.clientCA, c.modified = &cert, leaf, clientCAs, clientCA, modified
+	return true, nil
+}
+
+// picks up a renewed certificate, keeping the current one if the files can't be loaded, for example when only the
+// certificate or only the key has been replaced so far
+func (c *certReloader) current() (*tls.Certificate, *x509.CertPool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if changed, err := c.reload(); err != nil {
+		log.Printf("could not reload the server certificate, still using the old one: %s", err)
+	} else if changed {
+		log.Printf("reloaded the server certificate, valid until %s, SHA-256 fingerprint: %s", c.leaf.NotAfter.Format(time.RFC3339), CertFingerprint(c.leaf))
+		c.checkExpiry()
+	}
+	return c.cert, c.clientCAs
+}
+
+func (c *certReloader) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	cert, _ := c.current()
+	return cert, nil
+}
+
+// hands each handshake the current client CA, since ClientCAs can't be swapped on a shared tls.Config
+func (c *certReloader) getConfigForClient(config *tls.Config) func(*tls.ClientHelloInfo) (*tls.Config, error) {
+	return func(*tls.ClientHelloInfo) (*tls.Config, error) {
+		_, clientCAs := c.current()
+		clientConfig := config.Clone()
+		clientConfig.ClientCAs = clientCAs
+		return clientConfig, nil
+	}
+}
+
+// Must hold the lock
+func (c *certReloader) checkExpiry() {
+	certs := []*x509.Certificate{c.leaf}
+	if c.clientCAFile != c.certFile {
+		certs = append(certs, c.clientCA)
+	}
+	for _, cert := range certs {
+		if until := time.Until(cert.NotAfter); until < 0 {
+			log.Printf("WARNING: certificate %s expired on %s, clients will refuse to connect. Renew it with rotate-cert", cert.SerialNumber.Text(16), cert.NotAfter.Format(time.RFC3339))
+		} else if until < certExpiryWarning {
+			log.Printf("WARNING: certificate %s expires in %d days on %s. Renew it with rotate-cert", cert.SerialNumber.Text(16), int(until.Hours()/24), cert.NotAfter.Format(time.RFC3339))
+		}
+	}
+}
+
+func (c *certReloader) watchExpiry() {
+	for range time.Tick(certExpiryCheck) {
+		c.current()
+		c.lock.Lock()
+		c.checkExpiry()
+		c.lock.Unlock()
+	}
+}
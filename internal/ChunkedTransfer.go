@@ -0,0 +1,230 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+	"time"
+)
+
+const (
+	//largest request and response a chunked transfer can add up to, the server holds it all until the last chunk
+	maxChunkedTransferSize = 256 << 20
+	//largest transfer in a room that redacts with patterns, which holds back every chunk until the last one
+	maxHeldTransferSize = 16 << 20
+	//a head that hasn't ended by this size is redacted as it is rather than held back any longer
+	maxHeldHeadSize = 1 << 20
+	//transfers that go this long without a chunk are dropped
+	chunkedTransferTimeout = 5 * time.Minute
+	//transfers one client can have open in a room at once
+	maxOpenTransfersPerSender = 4
+	//bytes all the transfers open in a room can hold between them
+	maxRoomTransferBytes = 2 * maxChunkedTransferSize
+)
+
+// message types whose request and response bodies can be split across CHUNK_MESSAGEs
+var chunkableMessageTypes = map[string]bool{
+	"SCAN_ISSUE_MESSAGE": true,
+	"REPEATER_MESSAGE":   true,
+	"INTRUDER_MESSAGE":   true,
+	"BURP_MESSAGE":       true,
+}
+
+// TransferChunk is the Data payload of CHUNK_MESSAGE. A BurpRequestResponse too big for one message is sent as
+// Count chunks, each carrying the next part of its request and response bodies. The first chunk also carries the
+// httpService. Receivers append the parts in Index order and handle the result as MessageType once the last one
+// arrives, using RequestSize and ResponseSize to show progress
+type TransferChunk struct {
+	TransferId   string `json:"transferId"`
+	MessageType  string `json:"messageType"`
+	Index        int    `json:"index"`
+	Count        int    `json:"count"`
+	RequestSize  int    `json:"requestSize"`
+	ResponseSize int    `json:"responseSize"`
+}
+
+// tracks a transfer in progress so chunks are relayed in order and from one sender, and puts its bodies back
+// together for clients that can't
+type chunkedTransfer struct {
+	sender      *Client
+	nextIndex   int
+	count       int
+	messageType string
+	httpService *BurpMetaData
+	//the room's rules when the transfer started
+	redactor *Redactor
+	//patterns can match across chunks, so with them nothing is relayed until the whole message is redacted
+	held bool
+	//redacted parts relayed so far, or the raw bodies when held
+	request  []byte
+	response []byte
+	//the start of each body while its head is held back, nil when nothing is redacted
+	requestHead  *heldHead
+	responseHead *heldHead
+	//bytes received, which count towards the transfer and room limits
+	size      int
+	lastChunk time.Time
+}
+
+// the start of a body kept until its head is complete, so header and cookie rules see whole lines
+type heldHead struct {
+	held []byte
+	//set once the head has been redacted and relayed
+	done bool
+}
+
+func parseTransferChunk(data string) (*TransferChunk, error) {
+	chunk := &TransferChunk{}
+	if err := json.Unmarshal([]byte(data), chunk); err != nil {
+		return nil, newClientError(ErrorBadPayload, "chunk is not a valid JSON object")
+	}
+	if len(chunk.TransferId) == 0 {
+		return nil, newClientError(ErrorBadPayload, "chunk is missing its transfer id")
+	}
+	if !chunkableMessageTypes[chunk.MessageType] {
+		return nil, newClientError(ErrorBadPayload, "%s cannot be sent in chunks", chunk.MessageType)
+	}
+	if chunk.Count < 1 || chunk.Index < 0 || chunk.Index >= chunk.Count {
+		return nil, newClientError(ErrorBadPayload, "chunk %d of %d is out of range", chunk.Index, chunk.Count)
+	}
+	return chunk, nil
+}
+
+// checks the chunk continues a transfer from the same sender, starting a new one with the room's redactor on the
+// first chunk. Returns the redacted part of the chunk to relay, nil while the transfer is held, and the whole redacted
+// request once the last chunk arrives. Must hold the room lock
+func (r *Room) acceptChunk(sender *Client, chunk *TransferChunk, burpReqResp *BurpRequestResponse, redactor *Redactor) (*BurpRequestResponse, *BurpRequestResponse, error) {
+	transfer, ok := r.transfers[chunk.TransferId]
+	if !ok {
+		if chunk.Index != 0 {
+			return nil, nil, newClientError(ErrorBadPayload, "transfer %s has not started", chunk.TransferId)
+		}
+		if r.openTransfers(sender) >= maxOpenTransfersPerSender {
+			return nil, nil, newClientError(ErrorTransferLimit, "only %d transfers can be open at once", maxOpenTransfersPerSender)
+		}
+		transfer = &chunkedTransfer{sender: sender, count: chunk.Count, messageType: chunk.MessageType, redactor: redactor}
+		if redactor.active() && redactor.redactsHeadOnly() {
+			transfer.requestHead, transfer.responseHead = &heldHead{}, &heldHead{}
+		} else if redactor.active() {
+			transfer.held = true
+		}
+		if burpReqResp != nil {
+			transfer.httpService = burpReqResp.HttpService
+		}
+		r.transfers[chunk.TransferId] = transfer
+	}
+	if transfer.sender != sender || transfer.count != chunk.Count || transfer.nextIndex != chunk.Index || transfer.messageType != chunk.MessageType {
+		return nil, nil, newClientError(ErrorBadPayload, "chunk %d of transfer %s is out of order", chunk.Index, chunk.TransferId)
+	}
+	last := chunk.Index == chunk.Count-1
+	part := &BurpRequestResponse{}
+	if chunk.Index == 0 {
+		part.HttpService = transfer.httpService
+	}
+	if burpReqResp != nil {
+		chunkSize := len(burpReqResp.Request) + len(burpReqResp.Response)
+		if maxSize := transfer.maxSize(); transfer.size+chunkSize > maxSize {
+			r.dropTransfer(chunk.TransferId)
+			if transfer.held {
+				return nil, nil, newClientError(ErrorMessageTooLarge, "transfer %s is over the %d byte limit of rooms that redact with patterns", chunk.TransferId, maxSize)
+			}
+			return nil, nil, newClientError(ErrorMessageTooLarge, "transfer %s is over the %d byte limit", chunk.TransferId, maxSize)
+		}
+		//the transfer stays open so the sender can retry the chunk once others finish
+		if r.transferBytes+chunkSize > maxRoomTransferBytes {
+			return nil, nil, newClientError(ErrorTransferLimit, "room %s is already holding %d bytes of transfers", r.name, r.transferBytes)
+		}
+		part.Request, part.Response = burpReqResp.Request, burpReqResp.Response
+		transfer.size += chunkSize
+		r.transferBytes += chunkSize
+	}
+	if !transfer.held {
+		part.Request = transfer.requestHead.next(transfer.redactor, part.Request, last)
+		part.Response = transfer.responseHead.next(transfer.redactor, part.Response, last)
+	}
+	transfer.request = append(transfer.request, part.Request...)
+	transfer.response = append(transfer.response, part.Response...)
+	transfer.nextIndex++
+	transfer.lastChunk = time.Now()
+	if transfer.held {
+		part = nil
+	}
+	if !last {
+		return part, nil, nil
+	}
+	r.dropTransfer(chunk.TransferId)
+	complete := &BurpRequestResponse{
+		Request:     transfer.request,
+		Response:    transfer.response,
+		HttpService: transfer.httpService,
+	}
+	if transfer.held {
+		complete.Request = transfer.redactor.redact(complete.Request)
+		complete.Response = transfer.redactor.redact(complete.Response)
+	}
+	return part, complete, nil
+}
+
+func (t *chunkedTransfer) maxSize() int {
+	if t.held {
+		return maxHeldTransferSize
+	}
+	return maxChunkedTransferSize
+}
+
+// returns the part of a body that can be relayed, holding it back until the head is complete and then redacting it.
+// Everything after the head passes through, a nil heldHead passes everything through
+func (h *heldHead) next(redactor *Redactor, part []byte, last bool) []byte {
+	if h == nil || h.done {
+		return part
+	}
+	h.held = append(h.held, part...)
+	if !last && len(h.held) < maxHeldHeadSize && !bytes.Contains(h.held, []byte("\r\n\r\n")) {
+		return nil
+	}
+	redacted := redactor.redact(h.held)
+	h.held, h.done = nil, true
+	return redacted
+}
+
+// drops transfers that haven't had a chunk for chunkedTransferTimeout and tells their senders. Must hold the room lock
+func (r *Room) expireTransfers(h *Hub, now time.Time) {
+	for transferId, transfer := range r.transfers {
+		if now.Sub(transfer.lastChunk) < chunkedTransferTimeout {
+			continue
+		}
+		log.Printf("dropping transfer %s from %s in room %s, it stalled at chunk %d of %d", transferId, transfer.sender.name, r.name, transfer.nextIndex, transfer.count)
+		r.dropTransfer(transferId)
+		msg := NewBurpTCMessage()
+		msg.MessageType = "CHUNK_MESSAGE"
+		h.sendError(generateMessage(msg, transfer.sender, r.name), newClientError(ErrorTransferExpired, "transfer %s had no chunk for %s", transferId, chunkedTransferTimeout))
+	}
+}
+
+// forgets transfers a client left unfinished. Must hold the room lock
+func (r *Room) abandonTransfers(client *Client) {
+	for transferId, transfer := range r.transfers {
+		if transfer.sender == client {
+			r.dropTransfer(transferId)
+		}
+	}
+}
+
+// counts the transfers a client has open. Must hold the room lock
+func (r *Room) openTransfers(sender *Client) int {
+	open := 0
+	for _, transfer := range r.transfers {
+		if transfer.sender == sender {
+			open++
+		}
+	}
+	return open
+}
+
+// forgets a transfer and the bytes it was holding. Must hold the room lock
+func (r *Room) dropTransfer(transferId string) {
+	if transfer, ok := r.transfers[transferId]; ok {
+		r.transferBytes -= transfer.size
+		delete(r.transfers, transferId)
+	}
+}
@@ -1,23 +1,40 @@
 package internal
 
 import (
-	"bytes"
-	"encoding/base64"
-	"encoding/json"
 	"github.com/fasthttp/websocket"
+	"io"
+	"io/ioutil"
 	"log"
+	"sync"
 	"time"
 )
 
 type Client struct {
-	conn         *websocket.Conn
+	conn        *websocket.Conn
+	wireConn    *countingConn
+	sendChannel chan *Message
+	name        string
+	username    string
+	//the username was proved by a user account or client certificate rather than just claimed
+	verified bool
+	//negotiated the v2 wire format at upgrade
+	binary       bool
+	rateTokens   float64
+	rateRefilled time.Time
+	//guards everything below, clients are shared between the hub and room goroutines
+	lock         sync.Mutex
 	room         string
-	sendChannel  chan *Message
 	mutedClients []string
-	name         string
+	closed       bool
+	//from the client's HELLO_MESSAGE, no features until it sends one
+	features map[string]bool
+	//messages queued for a room and not yet handled, waited on before the hub handles the client's next message
+	roomMessages sync.WaitGroup
 }
 
 func (c *Client) isGivenClientMuted(clientName string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
 	for _, client := range c.mutedClients {
 		if client == clientName {
 			return true
@@ -26,6 +43,90 @@ func (c *Client) isGivenClientMuted(clientName string) bool {
 	return false
 }
 
+func (c *Client) getRoom() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.room
+}
+
+func (c *Client) setRoom(roomName string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.room = roomName
+}
+
+func (c *Client) setHello(clientHello *ClientHello) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.features = make(map[string]bool)
+	for _, feature := range clientHello.Features {
+		c.features[feature] = true
+	}
+}
+
+func (c *Client) hasFeature(feature string) bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.features[feature]
+}
+
+func (c *Client) isClosed() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.closed
+}
+
+// never blocks, a client whose send buffer is full is evicted instead
+func (c *Client) trySend(message *Message) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.closed {
+		return
+	}
+	select {
+	case c.sendChannel <- message:
+		log.Printf("Sent message %v to client %s", message, c.name)
+	default:
+		log.Printf("Evicting client %s, it is not keeping up with its messages", c.name)
+		c.closeSendChannel()
+		//closing a TLS connection waits on any blocked write, so don't hold up the room while it does.
+		//the reader then fails and unregisters the client through the hub
+		go func() { _ = c.conn.Close() }()
+	}
+}
+
+// stops any more messages being sent, this also stops the writer. Must hold the client lock
+func (c *Client) closeSendChannel() {
+	if !c.closed {
+		c.closed = true
+		close(c.sendChannel)
+	}
+}
+
+func (c *Client) close() {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.closeSendChannel()
+}
+
+// token bucket allowing bursts of up to one second worth of messages, a limit of 0 disables it
+func (c *Client) allowMessage(messagesPerSecond int) bool {
+	if messagesPerSecond <= 0 {
+		return true
+	}
+	now := time.Now()
+	c.rateTokens += now.Sub(c.rateRefilled).Seconds() * float64(messagesPerSecond)
+	if c.rateTokens > float64(messagesPerSecond) {
+		c.rateTokens = float64(messagesPerSecond)
+	}
+	c.rateRefilled = now
+	if c.rateTokens < 1 {
+		return false
+	}
+	c.rateTokens--
+	return true
+}
+
 func (c *Client) Reader() {
 	defer func() {
 		hub.unregister <- c
@@ -36,27 +137,54 @@ func (c *Client) Reader() {
 	}
 	c.conn.SetPongHandler(func(string) error { _ = c.conn.SetReadDeadline(time.Now().Add(60 * time.Second)); return nil })
 	for {
-		_, message, err := c.conn.ReadMessage()
+		frameType, frameReader, err := c.conn.NextReader()
 		if err != nil {
 			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
 				log.Printf("read error: %v from client: %s", err, c.name)
 			}
 			break
 		}
-		newBurpMessage := NewBurpTCMessage()
-		decodedBytes := make([]byte, base64.StdEncoding.DecodedLen(len(message)))
-		_, err = base64.StdEncoding.Decode(decodedBytes, message)
+		//read one byte past the limit to tell a message that fits exactly from one that doesn't
+		if hub.maxMessageSize > 0 {
+			frameReader = io.LimitReader(frameReader, hub.maxMessageSize+1)
+		}
+		message, err := ioutil.ReadAll(frameReader)
 		if err != nil {
-			log.Printf("error decoding base64: %v", err)
+			log.Printf("read error: %v from client: %s", err, c.name)
+			break
+		}
+		if hub.maxMessageSize > 0 && int64(len(message)) > hub.maxMessageSize {
+			//the rest of the message is skipped by the next read, so the client can send it again in chunks
+			log.Printf("client %s sent a message over the %d byte limit", c.name, hub.maxMessageSize)
+			hub.route(&Message{
+				msg:      NewBurpTCMessage(),
+				sender:   c,
+				roomName: c.getRoom(),
+				err:      newClientError(ErrorMessageTooLarge, "messages can't be bigger than %d bytes, send it in CHUNK_MESSAGEs instead", hub.maxMessageSize),
+			})
+			continue
 		}
-		if err := json.Unmarshal(bytes.Trim(decodedBytes, "\x00"), &newBurpMessage); err != nil {
-			log.Printf("Could not unmarshal BurpTCMessage, error: %s \n", err)
+		newBurpMessage, decodeErr := decodeBurpTCMessage(c.binary, frameType, message)
+		if decodeErr != nil {
+			hub.route(&Message{
+				msg:      newBurpMessage,
+				sender:   c,
+				roomName: c.getRoom(),
+				err:      decodeErr,
+			})
+		} else if !c.allowMessage(hub.messageRateLimit) {
+			hub.route(&Message{
+				msg:      newBurpMessage,
+				sender:   c,
+				roomName: c.getRoom(),
+				err:      newClientError(ErrorRateLimited, "more than %d messages per second", hub.messageRateLimit),
+			})
 		} else {
-			hub.messages <- &Message{
+			hub.route(&Message{
 				msg:      newBurpMessage,
 				sender:   c,
-				roomName: c.room,
-			}
+				roomName: c.getRoom(),
+			})
 		}
 	}
 }
@@ -83,17 +211,24 @@ func (c *Client) Writer() {
 
 				_ = c.conn.SetWriteDeadline(time.Now().Add(10 * time.Second))
 
-				if jsonBytes, err := json.Marshal(message.msg); err == nil {
-
-					encodedBuf := make([]byte, base64.StdEncoding.EncodedLen(len(jsonBytes)))
-					base64.StdEncoding.Encode(encodedBuf, jsonBytes)
-					if err := c.conn.WriteMessage(websocket.TextMessage, encodedBuf); err != nil {
+				if frameType, frame, err := encodeBurpTCMessage(c.binary, message.msg); err == nil {
+					//only does anything if the client negotiated compression
+					c.conn.EnableWriteCompression(len(frame) >= hub.compressionThreshold)
+					var written uint64
+					if c.wireConn != nil {
+						written = c.wireConn.bytesWritten()
+					}
+					if err := c.conn.WriteMessage(frameType, frame); err != nil {
 						log.Printf("Error Writing message: %s", err)
 						return
 					}
-
+					if c.wireConn != nil {
+						if room := hub.getRoom(message.roomName); room != nil {
+							room.recordTraffic(len(frame), c.wireConn.bytesWritten()-written)
+						}
+					}
 				} else {
-					log.Println("Error marshalling json message: ", err)
+					log.Println("Error marshalling message: ", err)
 				}
 			} else {
 				return
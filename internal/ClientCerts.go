@@ -0,0 +1,251 @@
+package internal
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const ClientCertsFileName = "clientCerts.json"
+
+// IssuedCert records a client certificate the server CA issued, so it can be listed and revoked later
+type IssuedCert struct {
+	Serial   string    `json:"serial"`
+	Username string    `json:"username"`
+	Issued   time.Time `json:"issued"`
+	Expires  time.Time `json:"expires"`
+	//zero until the certificate is revoked
+	Revoked time.Time `json:"revoked"`
+}
+
+// ClientCertStore keeps the certificates issued to users. The file is reread when it changes, so certificates revoked
+// from the command line are refused straight away by a running server
+type ClientCertStore struct {
+	path     string
+	lock     sync.Mutex
+	certs    map[string]*IssuedCert
+	modified time.Time
+}
+
+func LoadClientCertStore(path string) (*ClientCertStore, error) {
+	store := &ClientCertStore{
+		path:  path,
+		certs: make(map[string]*IssuedCert),
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store, store.reload()
+}
+
+// rereads the file if it changed since it was last read. Must hold the lock
+func (c *ClientCertStore) reload() error {
+	fileInfo, err := os.Stat(c.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fileInfo.ModTime().Equal(c.modified) {
+		return nil
+	}
+	fileBytes, err := ioutil.ReadFile(c.path)
+	if err != nil {
+		return err
+	}
+	var certs []*IssuedCert
+	if err := json.Unmarshal(fileBytes, &certs); err != nil {
+		return err
+	}
+	c.certs = make(map[string]*IssuedCert)
+	for _, cert := range certs {
+		c.certs[cert.Serial] = cert
+	}
+	c.modified = fileInfo.ModTime()
+	return nil
+}
+
+// Must hold the lock
+func (c *ClientCertStore) save() error {
+	fileBytes, err := json.MarshalIndent(c.list(), "", "  ")
+	if err != nil {
+		return err
+	}
+	//write to a temporary file first so a running server never reads a half written list
+	if err := ioutil.WriteFile(c.path+".tmp", fileBytes, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(c.path+".tmp", c.path); err != nil {
+		return err
+	}
+	if fileInfo, err := os.Stat(c.path); err == nil {
+		c.modified = fileInfo.ModTime()
+	}
+	return nil
+}
+
+// Must hold the lock
+func (c *ClientCertStore) list() []*IssuedCert {
+	certs := make([]*IssuedCert, 0, len(c.certs))
+	for _, cert := range c.certs {
+		certs = append(certs, cert)
+	}
+	sort.Slice(certs, func(i, j int) bool {
+		return certs[i].Issued.Before(certs[j].Issued)
+	})
+	return certs
+}
+
+func (c *ClientCertStore) List() ([]*IssuedCert, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.reload(); err != nil {
+		return nil, err
+	}
+	return c.list(), nil
+}
+
+// Issue creates a certificate and key for the user signed by the CA, returning both PEM encoded
+func (c *ClientCertStore) Issue(caCertPath string, caKeyPath string, username string, validity time.Duration) (*IssuedCert, []byte, []byte, error) {
+	if err := validateUsername(username); err != nil {
+		return nil, nil, nil, err
+	}
+	ca, err := tls.LoadX509KeyPair(caCertPath, caKeyPath)
+	if err != nil {
+		return nil, nil, nil, fmt.Errorf("could not load the server CA: %s", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if !caCert.IsCA {
+		return nil, nil, nil, errors.New(caCertPath + " is not a CA certificate")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	serialNumber, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serialNumber,
+		Subject: pkix.Name{
+			Organization: []string{"BurpTeamServer"},
+			CommonName:   username,
+		},
+		//allow for clocks that are a little behind
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(validity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+		BasicConstraintsValid: true,
+	}
+	derBytes, err := x509.CreateCertificate(rand.Reader, template, caCert, &key.PublicKey, ca.PrivateKey.(crypto.Signer))
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	issued := &IssuedCert{
+		Serial:   serialNumber.Text(16),
+		Username: username,
+		Issued:   now,
+		Expires:  template.NotAfter,
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.reload(); err != nil {
+		return nil, nil, nil, err
+	}
+	c.certs[issued.Serial] = issued
+	if err := c.save(); err != nil {
+		return nil, nil, nil, err
+	}
+	return issued, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), nil
+}
+
+// Revoke revokes the certificate with the given serial, or every certificate of the user when serial is empty,
+// and returns how many were revoked
+func (c *ClientCertStore) Revoke(username string, serial string) (int, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.reload(); err != nil {
+		return 0, err
+	}
+	revoked := 0
+	for _, cert := range c.certs {
+		if cert.Revoked.IsZero() && (cert.Serial == serial || (len(serial) == 0 && cert.Username == username)) {
+			cert.Revoked = time.Now()
+			revoked++
+		}
+	}
+	if revoked == 0 {
+		return 0, nil
+	}
+	return revoked, c.save()
+}
+
+// returns the username a certificate was issued to, or an error if the server never issued it or it was revoked
+func (c *ClientCertStore) checkCert(cert *x509.Certificate) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err := c.reload(); err != nil {
+		return "", err
+	}
+	issued, ok := c.certs[cert.SerialNumber.Text(16)]
+	if !ok || issued.Username != cert.Subject.CommonName {
+		return "", fmt.Errorf("client certificate %s was not issued by this server", cert.SerialNumber.Text(16))
+	}
+	if !issued.Revoked.IsZero() {
+		return "", fmt.Errorf("client certificate %s of %s was revoked", issued.Serial, issued.Username)
+	}
+	return issued.Username, nil
+}
+
+// checks the certificate a client connected with. The server's own CA certificate is still accepted from older
+// clients that were handed it, unless every client must have a certificate of their own
+func (c *ClientCertStore) verifyConnection(requireClientCerts bool) func(tls.ConnectionState) error {
+	return func(state tls.ConnectionState) error {
+		if len(state.PeerCertificates) == 0 {
+			return nil
+		}
+		if state.PeerCertificates[0].IsCA {
+			if requireClientCerts {
+				return errors.New("clients must connect with their own certificate")
+			}
+			return nil
+		}
+		_, err := c.checkCert(state.PeerCertificates[0])
+		return err
+	}
+}
+
+// returns the username of the certificate the client connected with, or an empty string if it didn't use one of
+// the certificates issued to users
+func clientCertUsername(ctx *fasthttp.RequestCtx) string {
+	state := ctx.TLSConnectionState()
+	if state == nil || len(state.VerifiedChains) == 0 || state.PeerCertificates[0].IsCA {
+		return ""
+	}
+	//verifyConnection already refused unknown and revoked certificates during the handshake
+	return state.PeerCertificates[0].Subject.CommonName
+}
@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"fmt"
+)
+
+const (
+	ErrorUnknownMessageType = "UNKNOWN_MESSAGE_TYPE"
+	ErrorRoomNotFound       = "ROOM_NOT_FOUND"
+	ErrorBadPayload         = "BAD_PAYLOAD"
+	ErrorPermissionDenied   = "PERMISSION_DENIED"
+	ErrorRateLimited        = "RATE_LIMITED"
+	ErrorBlobNotFound       = "BLOB_NOT_FOUND"
+	ErrorLinkNotFound       = "LINK_NOT_FOUND"
+	ErrorShortenerDisabled  = "SHORTENER_DISABLED"
+	ErrorMessageTooLarge    = "MESSAGE_TOO_LARGE"
+	ErrorTransferExpired    = "TRANSFER_EXPIRED"
+	ErrorTransferLimit      = "TRANSFER_LIMIT"
+	ErrorInternal           = "INTERNAL_ERROR"
+)
+
+// ClientError is a failure that is reported back to the client that caused it as an ERROR_MESSAGE
+type ClientError struct {
+	Code        string `json:"code"`
+	Reason      string `json:"reason"`
+	MessageType string `json:"msgtype"`
+}
+
+func newClientError(code string, format string, args ...interface{}) *ClientError {
+	return &ClientError{
+		Code:   code,
+		Reason: fmt.Sprintf(format, args...),
+	}
+}
+
+func (e *ClientError) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Reason)
+}
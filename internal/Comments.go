@@ -1,5 +1,12 @@
 package internal
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+)
+
 type Comments struct {
 	requestsWithComments map[string]BurpRequestResponse
 }
@@ -17,3 +24,33 @@ func (c *Comments) getRequestWithComments(key string) BurpRequestResponse {
 func (c *Comments) setRequestWithComments(key string, burpReqRespWithComments BurpRequestResponse) {
 	c.requestsWithComments[key] = burpReqRespWithComments
 }
+
+func (c *Comments) removeRequestWithComments(key string) {
+	delete(c.requestsWithComments, key)
+}
+
+func (c *Comments) getAllRequestsWithComments() []BurpRequestResponse {
+	requests := make([]BurpRequestResponse, 0, len(c.requestsWithComments))
+	for _, request := range c.requestsWithComments {
+		requests = append(requests, request)
+	}
+	return requests
+}
+
+// requests are identified by their raw bytes and the service they were sent to
+func commentKey(burpReqResp *BurpRequestResponse) string {
+	hash := sha256.New()
+	hash.Write(burpReqResp.Request)
+	if burpReqResp.HttpService != nil {
+		hash.Write([]byte("\x00" + burpReqResp.HttpService.Protocol + "://" + burpReqResp.HttpService.Host + ":" + strconv.Itoa(burpReqResp.HttpService.Port)))
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// comment authors are recorded with their client name, strip the connection number to compare users
+func usernameFromClientName(clientName string) string {
+	if i := strings.LastIndex(clientName, "#"); i >= 0 {
+		return clientName[:i]
+	}
+	return clientName
+}
@@ -0,0 +1,40 @@
+package internal
+
+import (
+	"crypto/tls"
+	"net"
+	"sync/atomic"
+)
+
+// wraps the TLS listener so the bytes websocket frames take on the wire can be compared to the messages in them
+type countingListener struct {
+	net.Listener
+}
+
+func (l countingListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		return &countingConn{Conn: tlsConn}, nil
+	}
+	return conn, nil
+}
+
+// embeds the TLS connection so fasthttp still sees it as one
+type countingConn struct {
+	//updated atomically, kept first so it stays 64-bit aligned
+	written uint64
+	*tls.Conn
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	atomic.AddUint64(&c.written, uint64(n))
+	return n, err
+}
+
+func (c *countingConn) bytesWritten() uint64 {
+	return atomic.LoadUint64(&c.written)
+}
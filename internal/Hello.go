@@ -0,0 +1,124 @@
+package internal
+
+import (
+	"encoding/json"
+	"sort"
+)
+
+// ProtocolVersion is bumped whenever BurpTCMessage or the message types change in a way clients need to know about.
+//
+//	1: the original protocol, clients that never send HELLO_MESSAGE are treated as this version
+//	2: HELLO_MESSAGE, structured errors, JSON room requests, roles, comments, history and persistent rooms
+//	3: CHUNK_MESSAGE, blob hashes and GET_BLOB_MESSAGE, link management and redaction rules
+const ProtocolVersion = 3
+
+// message types that are only advertised when the server feature they rely on is enabled
+var messageTypeFeatures = map[string]string{
+	"GET_HISTORY_MESSAGE":  "history",
+	"GET_BLOB_MESSAGE":     "blobs",
+	"SHORTEN_LINK_MESSAGE": "shortener",
+	"GET_LINKS_MESSAGE":    "shortener",
+	"GET_LINK_MESSAGE":     "shortener",
+	"REVOKE_LINK_MESSAGE":  "shortener",
+}
+
+// ClientHello is the Data payload a client sends in HELLO_MESSAGE right after connecting
+type ClientHello struct {
+	Version  int      `json:"version"`
+	Features []string `json:"features"`
+}
+
+type ServerLimits struct {
+	//0 when clients are not rate limited
+	MessagesPerSecond int `json:"messagesPerSecond"`
+	//largest message in bytes the server accepts, bigger bodies have to be sent in CHUNK_MESSAGEs. 0 when unlimited
+	MaxMessageSize int64 `json:"maxMessageSize"`
+	//largest request and response a series of CHUNK_MESSAGEs can add up to
+	MaxTransferSize int `json:"maxTransferSize"`
+	//largest transfer in a room whose redaction rules have patterns, which is only shared once it is complete
+	MaxRedactedTransferSize int `json:"maxRedactedTransferSize"`
+	CompressionThreshold    int `json:"compressionThreshold"`
+	HistoryPageSize         int `json:"historyPageSize"`
+	MaxRoomNameLength       int `json:"maxRoomNameLength"`
+	MaxRoomPasswordLength   int `json:"maxRoomPasswordLength"`
+}
+
+// ServerHello is the Data payload of the server's HELLO_MESSAGE reply
+type ServerHello struct {
+	Version      int          `json:"version"`
+	Features     []string     `json:"features"`
+	MessageTypes []string     `json:"messageTypes"`
+	Limits       ServerLimits `json:"limits"`
+}
+
+func parseClientHello(data string) (*ClientHello, error) {
+	clientHello := &ClientHello{}
+	if err := json.Unmarshal([]byte(data), clientHello); err != nil {
+		return nil, newClientError(ErrorBadPayload, "hello is not a valid JSON object")
+	}
+	if clientHello.Version < 1 {
+		return nil, newClientError(ErrorBadPayload, "hello is missing its protocol version")
+	}
+	return clientHello, nil
+}
+
+// optional server behaviour clients can check for in the HELLO_MESSAGE reply, depending on how the server was started
+func (h *Hub) serverFeatures() []string {
+	features := []string{
+		"chunkedTransfers",
+		"comments",
+		"compression",
+		"jsonRoomRequests",
+		"redaction",
+		"roles",
+		"structuredErrors",
+		WireProtocolV2,
+	}
+	if h.blobs != nil {
+		features = append(features, "blobs")
+	}
+	if h.history != nil {
+		features = append(features, "history")
+	}
+	if h.roomStore != nil {
+		features = append(features, "persistentRooms")
+	}
+	if h.shortenerService != nil {
+		features = append(features, "shortener")
+	}
+	sort.Strings(features)
+	return features
+}
+
+func (h *Hub) serverHello() *ServerHello {
+	features := h.serverFeatures()
+	enabled := make(map[string]bool)
+	for _, feature := range features {
+		enabled[feature] = true
+	}
+	//the routing tables hold exactly the types clients may send, replies and announcements only go the other way
+	var messageTypes []string
+	for _, routingTable := range []map[string]bool{hubMessageTypes, roomMessageTypes} {
+		for messageType := range routingTable {
+			if feature, ok := messageTypeFeatures[messageType]; !ok || enabled[feature] {
+				messageTypes = append(messageTypes, messageType)
+			}
+		}
+	}
+	sort.Strings(messageTypes)
+	return &ServerHello{
+		Version:      ProtocolVersion,
+		Features:     features,
+		MessageTypes: messageTypes,
+		Limits: ServerLimits{
+			MessagesPerSecond:       h.messageRateLimit,
+			MaxMessageSize:          h.maxMessageSize,
+			MaxTransferSize:         maxChunkedTransferSize,
+			MaxRedactedTransferSize: maxHeldTransferSize,
+			CompressionThreshold:    h.compressionThreshold,
+			HistoryPageSize:         defaultHistoryPageSize,
+			MaxRoomNameLength:       maxRoomNameLength,
+			MaxRoomPasswordLength:   maxRoomPasswordLength,
+		},
+	}
+}
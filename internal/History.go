@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"bufio"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const defaultHistoryPageSize = 50
+
+type HistoryEntry struct {
+	Sequence int            `json:"sequence"`
+	Sender   string         `json:"sender"`
+	Time     time.Time      `json:"time"`
+	Message  *BurpTCMessage `json:"message"`
+}
+
+type HistoryPage struct {
+	Offset  int             `json:"offset"`
+	Total   int             `json:"total"`
+	Entries []*HistoryEntry `json:"entries"`
+}
+
+type roomHistory struct {
+	file    *os.File
+	offsets []int64
+	size    int64
+}
+
+type HistoryStore struct {
+	directory string
+	rooms     map[string]*roomHistory
+	lock      sync.Mutex
+}
+
+func NewHistoryStore(directory string) (*HistoryStore, error) {
+	if err := os.MkdirAll(directory, 0700); err != nil {
+		return nil, err
+	}
+	return &HistoryStore{
+		directory: directory,
+		rooms:     make(map[string]*roomHistory),
+	}, nil
+}
+
+// room names are chosen by clients so they are hex encoded to keep them out of the path
+func (h *HistoryStore) roomPath(roomName string) string {
+	return filepath.Join(h.directory, hex.EncodeToString([]byte(roomName))+".jsonl")
+}
+
+func (h *HistoryStore) openRoom(roomName string) (*roomHistory, error) {
+	if history, ok := h.rooms[roomName]; ok {
+		return history, nil
+	}
+	file, err := os.OpenFile(h.roomPath(roomName), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	history := &roomHistory{file: file}
+	//index the start of every entry so pages can be read without scanning the whole file
+	reader := bufio.NewReader(file)
+	for {
+		line, err := reader.ReadBytes('\n')
+		if len(line) > 0 && line[len(line)-1] == '\n' {
+			history.offsets = append(history.offsets, history.size)
+			history.size += int64(len(line))
+		}
+		if err != nil {
+			if err != io.EOF {
+				_ = file.Close()
+				return nil, err
+			}
+			break
+		}
+	}
+	//drop any partially written trailing entry
+	if err := file.Truncate(history.size); err != nil {
+		_ = file.Close()
+		return nil, err
+	}
+	h.rooms[roomName] = history
+	return history, nil
+}
+
+func (h *HistoryStore) Append(roomName string, sender string, message *BurpTCMessage) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	history, err := h.openRoom(roomName)
+	if err != nil {
+		return err
+	}
+	entryBytes, err := json.Marshal(&HistoryEntry{
+		Sequence: len(history.offsets),
+		Sender:   sender,
+		Time:     time.Now(),
+		Message:  message,
+	})
+	if err != nil {
+		return err
+	}
+	entryBytes = append(entryBytes, '\n')
+	if _, err := history.file.WriteAt(entryBytes, history.size); err != nil {
+		return err
+	}
+	history.offsets = append(history.offsets, history.size)
+	history.size += int64(len(entryBytes))
+	return nil
+}
+
+func (h *HistoryStore) Page(roomName string, offset int, limit int) (*HistoryPage, error) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	history, err := h.openRoom(roomName)
+	if err != nil {
+		return nil, err
+	}
+	page := &HistoryPage{
+		Offset:  offset,
+		Total:   len(history.offsets),
+		Entries: []*HistoryEntry{},
+	}
+	if offset < 0 || offset >= len(history.offsets) {
+		return page, nil
+	}
+	end := offset + limit
+	if end > len(history.offsets) {
+		end = len(history.offsets)
+	}
+	reader := bufio.NewReader(io.NewSectionReader(history.file, history.offsets[offset], history.size-history.offsets[offset]))
+	for i := offset; i < end; i++ {
+		line, err := reader.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+		entry := &HistoryEntry{}
+		if err := json.Unmarshal(line, entry); err != nil {
+			return nil, err
+		}
+		page.Entries = append(page.Entries, entry)
+	}
+	return page, nil
+}
+
+// RemoveAllExcept deletes the history of every room not in roomNames, so a room left over from an earlier run
+// never hands its traffic to a new room that reuses its name
+func (h *HistoryStore) RemoveAllExcept(roomNames []string) {
+	keep := make(map[string]bool)
+	for _, roomName := range roomNames {
+		keep[roomName] = true
+	}
+	files, err := ioutil.ReadDir(h.directory)
+	if err != nil {
+		log.Printf("could not list room history: %s", err)
+		return
+	}
+	for _, file := range files {
+		roomName, err := hex.DecodeString(strings.TrimSuffix(file.Name(), ".jsonl"))
+		if err != nil || !strings.HasSuffix(file.Name(), ".jsonl") || keep[string(roomName)] {
+			continue
+		}
+		log.Printf("removing history of room %s from an earlier run", roomName)
+		h.Remove(string(roomName))
+	}
+}
+
+func (h *HistoryStore) Remove(roomName string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if history, ok := h.rooms[roomName]; ok {
+		_ = history.file.Close()
+		delete(h.rooms, roomName)
+	}
+	if err := os.Remove(h.roomPath(roomName)); err != nil && !os.IsNotExist(err) {
+		log.Printf("could not remove history for room %s: %s", roomName, err)
+	}
+}
@@ -0,0 +1,264 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/valyala/fasthttp"
+	"log"
+	"net/http"
+	"time"
+)
+
+// LinkInfo describes a shortened link without the request in it, so links can be listed without exposing them
+type LinkInfo struct {
+	Id string `json:"id"`
+	//left out when a client lists links it didn't create, since anyone with the url can view the request
+	URL              string        `json:"url,omitempty"`
+	HttpService      *BurpMetaData `json:"httpService"`
+	Creator          string        `json:"creator"`
+	Room             string        `json:"room"`
+	Created          time.Time     `json:"created"`
+	Expires          time.Time     `json:"expires"`
+	MaxViews         int           `json:"maxViews"`
+	Views            int           `json:"views"`
+	BurnAfterReading bool          `json:"burnAfterReading"`
+}
+
+// LinkRequest is the optional Data payload of SHORTEN_LINK_MESSAGE, matching the query parameters of the HTTP API
+type LinkRequest struct {
+	TTL      string `json:"ttl"`
+	MaxViews int    `json:"maxViews"`
+	Burn     bool   `json:"burn"`
+	//replaces the rules of the room the link is shared from
+	Redaction *RedactionRules `json:"redaction"`
+}
+
+func (shortenedUrls *ShortenedUrls) linkInfo(link *ShortenedLink) *LinkInfo {
+	return &LinkInfo{
+		Id:               link.Id,
+		URL:              shortenedUrls.linkURL(link.Id),
+		HttpService:      link.Request.HttpService,
+		Creator:          link.Creator,
+		Room:             link.Room,
+		Created:          link.Created,
+		Expires:          link.Expires,
+		MaxViews:         link.MaxViews,
+		Views:            link.Views,
+		BurnAfterReading: link.BurnAfterReading,
+	}
+}
+
+// returns the links still available, only those shared from the given room or by the given creator when they're set
+func (shortenedUrls *ShortenedUrls) listLinks(room string, creator string) ([]*LinkInfo, error) {
+	links, err := shortenedUrls.links.ListLinks()
+	if err != nil {
+		return nil, err
+	}
+	linkInfos := []*LinkInfo{}
+	for _, link := range links {
+		if (len(room) == 0 || link.Room == room) && (len(creator) == 0 || link.Creator == creator) {
+			linkInfos = append(linkInfos, shortenedUrls.linkInfo(link))
+		}
+	}
+	return linkInfos, nil
+}
+
+// returns nil if the link doesn't exist, looking at a link doesn't count as viewing it
+func (shortenedUrls *ShortenedUrls) inspectLink(id string) (*LinkInfo, error) {
+	link, err := shortenedUrls.links.GetLink(id)
+	if err != nil || link == nil {
+		return nil, err
+	}
+	return shortenedUrls.linkInfo(link), nil
+}
+
+func (shortenedUrls *ShortenedUrls) revokeLink(id string, revokedBy string) (bool, error) {
+	revoked, err := shortenedUrls.links.DeleteLink(id)
+	if revoked {
+		log.Printf("shortened url %s revoked by %s", id, revokedBy)
+	}
+	return revoked, err
+}
+
+// serves /shortener/links, which lists links, or with an id inspects or revokes one. Requires the admin key, since
+// the API key clients are given would let any of them see and revoke every link
+func (shortenedUrls *ShortenedUrls) handleLinks(ctx *fasthttp.RequestCtx) {
+	key := ctx.QueryArgs().Peek("key")
+	if key == nil {
+		ctx.Error("Improper key", fasthttp.StatusBadRequest)
+		return
+	}
+	if !shortenedUrls.checkAdminKey(key) {
+		ctx.Error("No.", fasthttp.StatusUnauthorized)
+		return
+	}
+	id := string(ctx.QueryArgs().Peek("id"))
+	var response interface{}
+	found := true
+	var err error
+	switch string(ctx.Method()) {
+	case http.MethodGet:
+		if len(id) == 0 {
+			response, err = shortenedUrls.listLinks(string(ctx.QueryArgs().Peek("room")), string(ctx.QueryArgs().Peek("creator")))
+		} else {
+			var linkInfo *LinkInfo
+			linkInfo, err = shortenedUrls.inspectLink(id)
+			found, response = linkInfo != nil, linkInfo
+		}
+	case http.MethodDelete:
+		found, err = shortenedUrls.revokeLink(id, ctx.RemoteAddr().String())
+		response = id
+	default:
+		ctx.Error("Unsupported method", fasthttp.StatusMethodNotAllowed)
+		return
+	}
+	if err == nil && !found {
+		ctx.Error("Bad Id", fasthttp.StatusNotFound)
+		return
+	}
+	if err != nil {
+		log.Printf("could not manage shortened urls: %s", err)
+		ctx.Error("Could not load links", http.StatusInternalServerError)
+		return
+	}
+	responseJson, err := json.Marshal(response)
+	if err != nil {
+		ctx.Error(err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ctx.Response.Header.Add("Content-Type", "application/json")
+	_, _ = ctx.Write(responseJson)
+}
+
+func (shortenedUrls *ShortenedUrls) parseLinkRequest(data string, redactor *Redactor) (*linkOptions, error) {
+	linkRequest := &LinkRequest{}
+	if len(data) > 0 {
+		if err := json.Unmarshal([]byte(data), linkRequest); err != nil {
+			return nil, errors.New("link request is not a valid JSON object")
+		}
+	}
+	options := &linkOptions{ttl: shortenedUrls.defaultTTL, maxViews: linkRequest.MaxViews, burnAfterReading: linkRequest.Burn, redactor: redactor}
+	if len(linkRequest.TTL) > 0 {
+		ttl, err := time.ParseDuration(linkRequest.TTL)
+		if err != nil || ttl < 0 {
+			return nil, errors.New("improper ttl")
+		}
+		options.ttl = ttl
+	}
+	if options.maxViews < 0 {
+		return nil, errors.New("improper maxViews")
+	}
+	if linkRequest.Redaction != nil {
+		var err error
+		if options.redactor, err = NewRedactor(linkRequest.Redaction); err != nil {
+			return nil, err
+		}
+	}
+	return options, nil
+}
+
+// whether the link was shared from room, rather than from an earlier room with the same name
+func (l *ShortenedLink) sharedFrom(room *Room) bool {
+	return room != nil && len(l.Room) > 0 && l.Room == room.name && l.RoomCreated.Equal(room.created)
+}
+
+// clients only see links shared from room, the one they are in, or by themselves
+func (l *ShortenedLink) visibleTo(client *Client, room *Room) bool {
+	return l.sharedFrom(room) || l.createdBy(client)
+}
+
+func (l *ShortenedLink) createdBy(client *Client) bool {
+	return len(l.Creator) > 0 && l.Creator == client.username
+}
+
+// describes a link to a client, leaving out the url unless they created it
+func (shortenedUrls *ShortenedUrls) linkInfoFor(client *Client, link *ShortenedLink) *LinkInfo {
+	linkInfo := shortenedUrls.linkInfo(link)
+	if !link.createdBy(client) {
+		linkInfo.URL = ""
+	}
+	return linkInfo
+}
+
+// handles the link message types for the hub, filling in the message Data for the reply. room is the one the sender
+// is in. New links are redacted with redactor unless they bring their own rules, and bodies sent by
+// hash are loaded from blobs. Links can be revoked by their creator or by anyone ownsRoom says owns the room they
+// were shared from
+func (shortenedUrls *ShortenedUrls) parseLinkMessage(message *Message, room *Room, redactor *Redactor, blobs *BlobStore, ownsRoom func(link *ShortenedLink) bool) error {
+	var reply interface{}
+	switch message.msg.MessageType {
+	case "SHORTEN_LINK_MESSAGE":
+		if message.msg.BurpRequestResponse == nil {
+			return newClientError(ErrorBadPayload, "link message is missing its request")
+		}
+		options, err := shortenedUrls.parseLinkRequest(message.msg.Data, redactor)
+		if err != nil {
+			if clientError, ok := err.(*ClientError); ok {
+				return clientError
+			}
+			return newClientError(ErrorBadPayload, "%s", err)
+		}
+		options.creator = message.sender.username
+		options.blobs = blobs
+		if room != nil && room.name != "server" {
+			options.room, options.roomCreated = room.name, room.created
+		}
+		id, err := shortenedUrls.addNewShortenURL(*message.msg.BurpRequestResponse, options)
+		if err != nil {
+			return err
+		}
+		message.msg.BurpRequestResponse = nil
+		message.msg.Data = shortenedUrls.linkURL(id)
+		return nil
+	case "GET_LINKS_MESSAGE":
+		links, err := shortenedUrls.links.ListLinks()
+		if err != nil {
+			return err
+		}
+		linkInfos := []*LinkInfo{}
+		for _, link := range links {
+			if link.visibleTo(message.sender, room) && (len(message.msg.Data) == 0 || link.Room == message.msg.Data) {
+				linkInfos = append(linkInfos, shortenedUrls.linkInfoFor(message.sender, link))
+			}
+		}
+		reply = linkInfos
+	case "GET_LINK_MESSAGE":
+		link, err := shortenedUrls.links.GetLink(message.msg.Data)
+		if err != nil {
+			return err
+		}
+		if link == nil || !link.visibleTo(message.sender, room) {
+			return newClientError(ErrorLinkNotFound, "link %s does not exist", message.msg.Data)
+		}
+		reply = shortenedUrls.linkInfoFor(message.sender, link)
+	case "REVOKE_LINK_MESSAGE":
+		link, err := shortenedUrls.links.GetLink(message.msg.Data)
+		if err != nil {
+			return err
+		}
+		if link == nil {
+			return newClientError(ErrorLinkNotFound, "link %s does not exist", message.msg.Data)
+		}
+		if !link.createdBy(message.sender) && !ownsRoom(link) {
+			//links the client can't see don't exist as far as it knows
+			if !link.visibleTo(message.sender, room) {
+				return newClientError(ErrorLinkNotFound, "link %s does not exist", message.msg.Data)
+			}
+			return newClientError(ErrorPermissionDenied, "only the creator of link %s or an owner of room %s can revoke it", link.Id, link.Room)
+		}
+		revoked, err := shortenedUrls.revokeLink(message.msg.Data, message.sender.name)
+		if err != nil {
+			return err
+		}
+		if !revoked {
+			return newClientError(ErrorLinkNotFound, "link %s does not exist", message.msg.Data)
+		}
+		return nil
+	}
+	replyBytes, err := json.Marshal(reply)
+	if err != nil {
+		return err
+	}
+	message.msg.Data = string(replyBytes)
+	return nil
+}
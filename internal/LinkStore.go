@@ -0,0 +1,192 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"go.etcd.io/bbolt"
+	"sort"
+	"time"
+)
+
+var linksBucket = []byte("links")
+
+// ShortenedLink is a request shared through the URL shortener
+type ShortenedLink struct {
+	Id      string               `json:"id"`
+	Request *BurpRequestResponse `json:"request"`
+	Created time.Time            `json:"created"`
+	//zero when the link never expires
+	Expires time.Time `json:"expires"`
+	//0 when the link can be viewed any number of times
+	MaxViews         int  `json:"maxViews"`
+	Views            int  `json:"views"`
+	BurnAfterReading bool `json:"burnAfterReading"`
+	//user that shared the link and the room they were in, empty when it was shared from outside a room
+	Creator string `json:"creator"`
+	Room    string `json:"room"`
+	//when that room was created, so a later room with the same name doesn't get its links
+	RoomCreated time.Time `json:"roomCreated"`
+}
+
+func (l *ShortenedLink) expired(now time.Time) bool {
+	return !l.Expires.IsZero() && now.After(l.Expires)
+}
+
+type LinkStore struct {
+	db *bbolt.DB
+}
+
+func NewLinkStore(path string) (*LinkStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(linksBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	return &LinkStore{db}, nil
+}
+
+var errLinkExists = errors.New("a link with this id already exists")
+
+// saves a new link, failing with errLinkExists rather than replacing a link with the same id
+func (l *LinkStore) CreateLink(link *ShortenedLink) error {
+	linkBytes, err := json.Marshal(link)
+	if err != nil {
+		return err
+	}
+	return l.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(linksBucket)
+		if bucket.Get([]byte(link.Id)) != nil {
+			return errLinkExists
+		}
+		return bucket.Put([]byte(link.Id), linkBytes)
+	})
+}
+
+// counts a view of the link and returns it, deleting it once it has used up its views. Returns nil for missing or expired links
+func (l *LinkStore) ViewLink(id string) (*ShortenedLink, error) {
+	var link *ShortenedLink
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(linksBucket)
+		linkBytes := bucket.Get([]byte(id))
+		if linkBytes == nil {
+			return nil
+		}
+		stored := &ShortenedLink{}
+		if err := json.Unmarshal(linkBytes, stored); err != nil {
+			return err
+		}
+		if stored.expired(time.Now()) {
+			return bucket.Delete([]byte(id))
+		}
+		link = stored
+		link.Views++
+		if link.BurnAfterReading || (link.MaxViews > 0 && link.Views >= link.MaxViews) {
+			return bucket.Delete([]byte(id))
+		}
+		updatedBytes, err := json.Marshal(link)
+		if err != nil {
+			return err
+		}
+		return bucket.Put([]byte(id), updatedBytes)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// returns the link without counting a view, or nil if it doesn't exist or has expired
+func (l *LinkStore) GetLink(id string) (*ShortenedLink, error) {
+	var link *ShortenedLink
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		linkBytes := tx.Bucket(linksBucket).Get([]byte(id))
+		if linkBytes == nil {
+			return nil
+		}
+		stored := &ShortenedLink{}
+		if err := json.Unmarshal(linkBytes, stored); err != nil {
+			return err
+		}
+		if !stored.expired(time.Now()) {
+			link = stored
+		}
+		return nil
+	})
+	return link, err
+}
+
+// returns every link that hasn't expired, oldest first
+func (l *LinkStore) ListLinks() ([]*ShortenedLink, error) {
+	var links []*ShortenedLink
+	now := time.Now()
+	err := l.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(linksBucket).ForEach(func(id, linkBytes []byte) error {
+			stored := &ShortenedLink{}
+			if err := json.Unmarshal(linkBytes, stored); err != nil {
+				return err
+			}
+			if !stored.expired(now) {
+				links = append(links, stored)
+			}
+			return nil
+		})
+	})
+	sort.Slice(links, func(i, j int) bool {
+		return links[i].Created.Before(links[j].Created)
+	})
+	return links, err
+}
+
+// deletes the link, returning false if there was no such link
+func (l *LinkStore) DeleteLink(id string) (bool, error) {
+	deleted := false
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(linksBucket)
+		if bucket.Get([]byte(id)) == nil {
+			return nil
+		}
+		deleted = true
+		return bucket.Delete([]byte(id))
+	})
+	return deleted, err
+}
+
+// deletes every link that expired before now and returns how many there were
+func (l *LinkStore) ReapExpired(now time.Time) (int, error) {
+	reaped := 0
+	err := l.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(linksBucket)
+		var expiredIds [][]byte
+		if err := bucket.ForEach(func(id, linkBytes []byte) error {
+			stored := &ShortenedLink{}
+			if err := json.Unmarshal(linkBytes, stored); err != nil {
+				return err
+			}
+			if stored.expired(now) {
+				expiredIds = append(expiredIds, append([]byte(nil), id...))
+			}
+			return nil
+		}); err != nil {
+			return err
+		}
+		//bbolt doesn't allow deleting while iterating
+		for _, id := range expiredIds {
+			if err := bucket.Delete(id); err != nil {
+				return err
+			}
+		}
+		reaped = len(expiredIds)
+		return nil
+	})
+	return reaped, err
+}
+
+func (l *LinkStore) Close() error {
+	return l.db.Close()
+}
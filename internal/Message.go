@@ -4,4 +4,10 @@ type Message struct {
 	msg      *BurpTCMessage
 	sender   *Client
 	roomName string
+	err      *ClientError
+	//closed once the hub has handled the message, room messages don't use it
+	done chan struct{}
+	//room passwords checked or hashed by the sender's reader before the hub sees the message
+	passwordRoom *Room
+	passwordHash []byte
 }
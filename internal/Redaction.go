@@ -0,0 +1,222 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"regexp"
+	"strings"
+)
+
+// RedactedPlaceholder replaces every redacted value
+const RedactedPlaceholder = "[REDACTED]"
+
+// used when the server is started without -redactionRules
+var defaultRedactionRules = RedactionRules{
+	Headers: []string{"Authorization", "Proxy-Authorization"},
+}
+
+// message types whose requests are redacted before they are stored or forwarded
+var redactedMessageTypes = map[string]bool{
+	"COOKIE_MESSAGE":     true,
+	"SCAN_ISSUE_MESSAGE": true,
+	"REPEATER_MESSAGE":   true,
+	"INTRUDER_MESSAGE":   true,
+	"BURP_MESSAGE":       true,
+}
+
+// RedactionRules pick what is replaced with RedactedPlaceholder in shared requests and responses. Header names are
+// matched ignoring case, cookie names exactly. Patterns are regular expressions matched against the whole message,
+// replacing just their capture groups if they have any and the whole match otherwise
+type RedactionRules struct {
+	Headers  []string `json:"headers"`
+	Cookies  []string `json:"cookies"`
+	Patterns []string `json:"patterns"`
+}
+
+// Redactor applies a set of RedactionRules, a nil Redactor redacts nothing
+type Redactor struct {
+	rules    *RedactionRules
+	headers  map[string]bool
+	cookies  map[string]bool
+	patterns []*regexp.Regexp
+}
+
+func NewRedactor(rules *RedactionRules) (*Redactor, error) {
+	redactor := &Redactor{
+		rules:   rules,
+		headers: make(map[string]bool),
+		cookies: make(map[string]bool),
+	}
+	for _, header := range rules.Headers {
+		redactor.headers[strings.ToLower(strings.TrimSpace(header))] = true
+	}
+	for _, cookie := range rules.Cookies {
+		redactor.cookies[strings.TrimSpace(cookie)] = true
+	}
+	for _, pattern := range rules.Patterns {
+		compiled, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, newClientError(ErrorBadPayload, "redaction pattern %q is invalid: %s", pattern, err)
+		}
+		redactor.patterns = append(redactor.patterns, compiled)
+	}
+	return redactor, nil
+}
+
+func parseRedactionRules(data string) (*Redactor, error) {
+	rules := &RedactionRules{}
+	if err := json.Unmarshal([]byte(data), rules); err != nil {
+		return nil, newClientError(ErrorBadPayload, "redaction rules are not a valid JSON object")
+	}
+	return NewRedactor(rules)
+}
+
+// LoadRedactionRules reads the server's default rules from a JSON file, or uses the built in ones if path is empty
+func LoadRedactionRules(path string) (*Redactor, error) {
+	if len(path) == 0 {
+		return NewRedactor(&defaultRedactionRules)
+	}
+	rulesBytes, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseRedactionRules(string(rulesBytes))
+}
+
+func (r *Redactor) active() bool {
+	return r != nil && (len(r.headers) > 0 || len(r.cookies) > 0 || len(r.patterns) > 0)
+}
+
+// header and cookie rules only look at the head of a message, while patterns can match anywhere in it
+func (r *Redactor) redactsHeadOnly() bool {
+	return r != nil && len(r.patterns) == 0
+}
+
+func (r *Redactor) getRules() *RedactionRules {
+	if r == nil {
+		return &RedactionRules{}
+	}
+	return r.rules
+}
+
+// redacts a raw HTTP message
+func (r *Redactor) redact(message []byte) []byte {
+	if !r.active() || len(message) == 0 {
+		return message
+	}
+	if len(r.headers) > 0 || len(r.cookies) > 0 {
+		head, body := message, []byte(nil)
+		if headEnd := bytes.Index(message, []byte("\r\n\r\n")); headEnd >= 0 {
+			head, body = message[:headEnd], message[headEnd:]
+		}
+		lines := strings.Split(string(head), "\r\n")
+		//the first line is the request or status line
+		for i := 1; i < len(lines); i++ {
+			lines[i] = r.redactHeader(lines[i])
+		}
+		message = append([]byte(strings.Join(lines, "\r\n")), body...)
+	}
+	for _, pattern := range r.patterns {
+		message = redactPattern(pattern, message)
+	}
+	return message
+}
+
+func (r *Redactor) redactHeader(line string) string {
+	colon := strings.Index(line, ":")
+	if colon < 0 {
+		return line
+	}
+	name := strings.ToLower(strings.TrimSpace(line[:colon]))
+	if r.headers[name] {
+		return line[:colon+1] + " " + RedactedPlaceholder
+	}
+	if len(r.cookies) == 0 {
+		return line
+	}
+	switch name {
+	case "cookie":
+		pairs := strings.Split(line[colon+1:], ";")
+		for i, pair := range pairs {
+			pairs[i] = r.redactCookie(pair)
+		}
+		return line[:colon+1] + strings.Join(pairs, ";")
+	case "set-cookie":
+		//only the first pair is the cookie, the rest are its attributes
+		parts := strings.SplitN(line[colon+1:], ";", 2)
+		parts[0] = r.redactCookie(parts[0])
+		return line[:colon+1] + strings.Join(parts, ";")
+	}
+	return line
+}
+
+func (r *Redactor) redactCookie(pair string) string {
+	equals := strings.Index(pair, "=")
+	if equals < 0 || !r.cookies[strings.TrimSpace(pair[:equals])] {
+		return pair
+	}
+	return pair[:equals+1] + RedactedPlaceholder
+}
+
+func redactPattern(pattern *regexp.Regexp, message []byte) []byte {
+	if pattern.NumSubexp() == 0 {
+		return pattern.ReplaceAllLiteral(message, []byte(RedactedPlaceholder))
+	}
+	var redacted []byte
+	last := 0
+	for _, match := range pattern.FindAllSubmatchIndex(message, -1) {
+		//pairs after the first are the capture groups, skipping ones that didn't match or sit inside an earlier group
+		for group := 2; group < len(match); group += 2 {
+			start, end := match[group], match[group+1]
+			if start < last || start < 0 {
+				continue
+			}
+			redacted = append(redacted, message[last:start]...)
+			redacted = append(redacted, RedactedPlaceholder...)
+			last = end
+		}
+	}
+	if redacted == nil {
+		return message
+	}
+	return append(redacted, message[last:]...)
+}
+
+// returns a copy of the request with its bodies redacted, loading bodies that were only sent by hash from blobs
+func (r *Redactor) redactRequest(blobs *BlobStore, burpReqResp *BurpRequestResponse) (*BurpRequestResponse, error) {
+	redacted, err := blobs.loadBodies(burpReqResp)
+	if err != nil {
+		return nil, err
+	}
+	redacted.Request = r.redact(redacted.Request)
+	redacted.Response = r.redact(redacted.Response)
+	//the hashes belonged to the bodies before redaction
+	redacted.RequestHash, redacted.ResponseHash = "", ""
+	return redacted, nil
+}
+
+// the rules for messages shared in the room, the server's defaults unless the room set its own. Must hold the room lock
+func (h *Hub) roomRedactor(room *Room) *Redactor {
+	if room.redactor != nil {
+		return room.redactor
+	}
+	return h.redactor
+}
+
+// replaces the message's request with a redacted copy unless it is a COOKIE_MESSAGE sent with noRedact. Must hold the room lock
+func (h *Hub) redactMessage(room *Room, message *Message) error {
+	redactor := h.roomRedactor(room)
+	if !redactor.active() || message.msg.BurpRequestResponse == nil {
+		return nil
+	}
+	if message.msg.NoRedact && message.msg.MessageType == "COOKIE_MESSAGE" {
+		return nil
+	}
+	redacted, err := redactor.redactRequest(h.roomBlobs(room), message.msg.BurpRequestResponse)
+	if err != nil {
+		return err
+	}
+	message.msg.BurpRequestResponse = redacted
+	return nil
+}
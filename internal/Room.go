@@ -1,17 +1,262 @@
 package internal
 
+import (
+	"golang.org/x/crypto/bcrypt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	RoleObserver = "observer"
+	RoleMember   = "member"
+	RoleOwner    = "owner"
+)
+
+var roleRanks = map[string]int{
+	RoleObserver: 0,
+	RoleMember:   1,
+	RoleOwner:    2,
+}
+
+var rolesByRank = []string{RoleObserver, RoleMember, RoleOwner}
+
+// Room messages are handled on the room's own goroutine, the hub only takes the lock to change membership
 type Room struct {
+	//updated atomically by every member's writer, kept first so they stay 64-bit aligned
+	messageBytes uint64
+	wireBytes    uint64
+	//name, created, passwordHash and persistent never change once the room is created
+	name string
+	//tells the room apart from earlier rooms with the same name
+	created      time.Time
+	passwordHash []byte
+	persistent   bool
+	messages     chan *Message
+	quit         chan struct{}
+	//guards stopped, nothing is queued once the room is stopped
+	queueLock sync.RWMutex
+	stopped   bool
+	//guards everything below
+	lock     sync.Mutex
 	scope    string
-	name     string
-	password string
+	owner    string
 	clients  map[string]*Client
+	comments Comments
+	roles    map[string]string
+	bans     map[string]bool
+	//client names that joined as observers, only for as long as they stay in the room
+	observers map[string]bool
+	//nil when the room uses the server's redaction rules
+	redactor *Redactor
+	//chunked transfers in progress by transfer id
+	transfers map[string]*chunkedTransfer
+	//bytes held by transfers
+	transferBytes int
+	//when the last member left, zero while the room has members
+	emptySince time.Time
+}
+
+func NewRoom(roomName string, password string) (*Room, error) {
+	var passwordHash []byte
+	if len(password) > 0 {
+		var err error
+		if passwordHash, err = bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost); err != nil {
+			return nil, err
+		}
+	}
+	return newRoom(roomName, passwordHash, false), nil
 }
 
-func NewRoom(roomName string, password string) *Room {
+func newRoom(roomName string, passwordHash []byte, persistent bool) *Room {
 	return &Room{
-		"",
-		roomName,
-		password,
-		make(map[string]*Client),
+		name:         roomName,
+		created:      time.Now(),
+		passwordHash: passwordHash,
+		persistent:   persistent,
+		messages:     make(chan *Message, 1024),
+		quit:         make(chan struct{}),
+		clients:      make(map[string]*Client),
+		comments:     NewComments(),
+		roles:        make(map[string]string),
+		observers:    make(map[string]bool),
+		bans:         make(map[string]bool),
+		transfers:    make(map[string]*chunkedTransfer),
+	}
+}
+
+func (r *Room) eventLoop(h *Hub) {
+	transferTicker := time.NewTicker(chunkedTransferTimeout / 5)
+	defer transferTicker.Stop()
+	for {
+		select {
+		case now := <-transferTicker.C:
+			r.lock.Lock()
+			r.expireTransfers(h, now)
+			r.lock.Unlock()
+		case message := <-r.messages:
+			select {
+			case <-r.quit:
+				r.refuse(h, message)
+				continue
+			default:
+			}
+			h.handleMessage(message, func(message *Message) error {
+				r.lock.Lock()
+				defer r.lock.Unlock()
+				return h.parseRoomMessage(r, message)
+			})
+			message.sender.roomMessages.Done()
+		case <-r.quit:
+			//stop made sure nothing more can be queued, so this answers everything that is left
+			for {
+				select {
+				case message := <-r.messages:
+					r.refuse(h, message)
+				default:
+					return
+				}
+			}
+		}
+	}
+}
+
+// answers a message that was queued before the room was deleted
+func (r *Room) refuse(h *Hub, message *Message) {
+	h.sendError(message, newClientError(ErrorRoomNotFound, "room %s was deleted", r.name))
+	message.sender.roomMessages.Done()
+}
+
+// queues a message for the room, returning false if the room has been deleted
+func (r *Room) enqueue(message *Message) bool {
+	r.queueLock.RLock()
+	defer r.queueLock.RUnlock()
+	if r.stopped {
+		return false
+	}
+	message.sender.roomMessages.Add(1)
+	r.messages <- message
+	return true
+}
+
+// stops the room goroutine once every message already being queued is in, any it hasn't handled are refused
+func (r *Room) stop() {
+	r.queueLock.Lock()
+	r.stopped = true
+	r.queueLock.Unlock()
+	close(r.quit)
+}
+
+// RoomStats compares the size of the messages sent to a room's members with the bytes they took on the wire
+type RoomStats struct {
+	MessageBytes uint64 `json:"messageBytes"`
+	WireBytes    uint64 `json:"wireBytes"`
+	BytesSaved   int64  `json:"bytesSaved"`
+}
+
+func (r *Room) recordTraffic(messageBytes int, wireBytes uint64) {
+	atomic.AddUint64(&r.messageBytes, uint64(messageBytes))
+	atomic.AddUint64(&r.wireBytes, wireBytes)
+}
+
+func (r *Room) getStats() *RoomStats {
+	messageBytes := atomic.LoadUint64(&r.messageBytes)
+	wireBytes := atomic.LoadUint64(&r.wireBytes)
+	return &RoomStats{
+		MessageBytes: messageBytes,
+		WireBytes:    wireBytes,
+		BytesSaved:   int64(messageBytes) - int64(wireBytes),
+	}
+}
+
+func (r *Room) hasPassword() bool {
+	return len(r.passwordHash) > 0
+}
+
+func (r *Room) checkPassword(password string) bool {
+	return bcrypt.CompareHashAndPassword(r.passwordHash, []byte(password)) == nil
+}
+
+// the creator of a room is always an owner, everyone else is a member unless promoted or demoted
+func (r *Room) roleOf(username string) string {
+	if username == r.owner {
+		return RoleOwner
+	}
+	if role, ok := r.roles[username]; ok {
+		return role
+	}
+	return RoleMember
+}
+
+// the role of one connection, which is its user's role unless it joined as an observer for this session
+func (r *Room) clientRole(client *Client) string {
+	role := r.roleOf(client.username)
+	if role == RoleMember && r.observers[client.name] {
+		return RoleObserver
+	}
+	return role
+}
+
+func (r *Room) hasRole(client *Client, role string) bool {
+	//the lobby has no owner, so everyone can share there but nobody can run it
+	if r.name == "server" {
+		return roleRanks[role] <= roleRanks[RoleMember]
+	}
+	return roleRanks[r.clientRole(client)] >= roleRanks[role]
+}
+
+// moves a user up or down one role, returning false if they are already at the limit
+func (r *Room) changeRole(username string, promote bool) bool {
+	if username == r.owner {
+		return false
+	}
+	rank := roleRanks[r.roleOf(username)]
+	if promote {
+		rank++
+	} else {
+		rank--
+	}
+	if rank < 0 || rank >= len(rolesByRank) {
+		return false
+	}
+	r.roles[username] = rolesByRank[rank]
+	return true
+}
+
+func (r *Room) isBanned(username string) bool {
+	return r.bans[username]
+}
+
+func (r *Room) getRoles() map[string]string {
+	roles := make(map[string]string)
+	for _, roomMember := range r.clients {
+		roles[roomMember.name] = r.clientRole(roomMember)
+	}
+	return roles
+}
+
+// records when the room was left empty, returning true if it now is. Must hold the room lock
+func (r *Room) markIfEmpty() bool {
+	if len(r.clients) > 0 {
+		return false
+	}
+	r.emptySince = time.Now()
+	return true
+}
+
+// copies the room members so they can be moved without holding the room lock
+func (r *Room) getClients() []*Client {
+	clients := make([]*Client, 0, len(r.clients))
+	for _, roomMember := range r.clients {
+		clients = append(clients, roomMember)
+	}
+	return clients
+}
+
+// nil when the room uses the server's redaction rules. Must hold the room lock
+func (r *Room) getRedactionRules() *RedactionRules {
+	if r.redactor == nil {
+		return nil
 	}
+	return r.redactor.getRules()
 }
@@ -0,0 +1,442 @@
+package internal
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// handles messages that only touch the sender's room, always on the room's goroutine with the room lock held
+func (h *Hub) parseRoomMessage(room *Room, message *Message) error {
+	//the sender moved rooms after this message was queued
+	if room.clients[message.sender.name] != message.sender {
+		return newClientError(ErrorRoomNotFound, "%s is no longer in room %s", message.sender.name, room.name)
+	}
+	if requiredRole, ok := requiredRoles[message.msg.MessageType]; ok && !room.hasRole(message.sender, requiredRole) {
+		return newClientError(ErrorPermissionDenied, "%s requires the %s role in room %s", message.msg.MessageType, requiredRole, room.name)
+	}
+	if redactedMessageTypes[message.msg.MessageType] {
+		if err := h.redactMessage(room, message); err != nil {
+			return err
+		}
+	}
+	switch message.msg.MessageType {
+	case "SET_SCOPE_MESSAGE":
+		log.Printf("received new scope from %s", message.sender.name)
+		room.scope = message.msg.Data
+		h.persistRoom(room)
+	case "GET_SCOPE_MESSAGE":
+		log.Printf("%s requesting scope", message.sender.name)
+		message.msg.Data = room.scope
+		message.sender.trySend(message)
+	case "PROMOTE_MESSAGE":
+		fallthrough
+	case "DEMOTE_MESSAGE":
+		targetClient, ok := room.clients[message.msg.Data]
+		if !ok {
+			return newClientError(ErrorBadPayload, "%s is not in room %s", message.msg.Data, room.name)
+		}
+		promote := message.msg.MessageType == "PROMOTE_MESSAGE"
+		if promote && room.clientRole(targetClient) != room.roleOf(targetClient.username) {
+			//promoting someone who joined as an observer just ends that for this session
+			delete(room.observers, targetClient.name)
+		} else if !room.changeRole(targetClient.username, promote) {
+			return newClientError(ErrorPermissionDenied, "cannot change the role of %s", targetClient.name)
+		}
+		log.Printf("%s changed %s to %s in room %s", message.sender.name, targetClient.name, room.clientRole(targetClient), room.name)
+		h.persistRoom(room)
+		return h.announceRoles(room)
+	case "UNBAN_MESSAGE":
+		//bans are kept by username, so a client name is as good as the username
+		targetUsername := usernameFromClientName(message.msg.Data)
+		if !room.isBanned(targetUsername) {
+			return newClientError(ErrorBadPayload, "%s is not banned from room %s", targetUsername, room.name)
+		}
+		log.Printf("%s unbanned %s from room %s", message.sender.name, targetUsername, room.name)
+		delete(room.bans, targetUsername)
+		h.persistRoom(room)
+	case "GET_ROLES_MESSAGE":
+		rolesBytes, err := json.Marshal(room.getRoles())
+		if err != nil {
+			return err
+		}
+		message.msg.MessageType = "ROLES_MESSAGE"
+		message.msg.Data = string(rolesBytes)
+		message.sender.trySend(message)
+	case "MUTE_MESSAGE":
+		message.sender.lock.Lock()
+		if message.msg.Data == "All" {
+			for _, roomMember := range room.clients {
+				if roomMember.name != message.sender.name {
+					message.sender.mutedClients = append(message.sender.mutedClients, roomMember.name)
+				}
+			}
+		} else {
+			if message.msg.Data != message.sender.name {
+				message.sender.mutedClients = append(message.sender.mutedClients, message.msg.Data)
+			}
+		}
+		log.Printf("%s muted these clients %s", message.sender.name, message.sender.mutedClients)
+		message.sender.lock.Unlock()
+	case "UNMUTE_MESSAGE":
+		message.sender.lock.Lock()
+		if message.msg.Data == "All" {
+			for _, roomMember := range room.clients {
+				if roomMember.name != message.sender.name {
+					message.sender.mutedClients = remove(message.sender.mutedClients, index(message.sender.mutedClients, roomMember.name))
+				}
+			}
+		} else {
+			if message.msg.Data != message.sender.name {
+				message.sender.mutedClients = remove(message.sender.mutedClients, index(message.sender.mutedClients, message.msg.Data))
+			}
+		}
+		message.sender.lock.Unlock()
+		log.Printf("%s unmuted %s", message.sender.name, message.msg.Data)
+	case "COOKIE_MESSAGE":
+		fallthrough
+	case "SCAN_ISSUE_MESSAGE":
+		fallthrough
+	case "REPEATER_MESSAGE":
+		fallthrough
+	case "INTRUDER_MESSAGE":
+		fallthrough
+	case "BURP_MESSAGE":
+		return h.shareRequest(room, message, "")
+	case "CHUNK_MESSAGE":
+		chunk, err := parseTransferChunk(message.msg.Data)
+		if err != nil {
+			return err
+		}
+		part, complete, err := room.acceptChunk(message.sender, chunk, message.msg.BurpRequestResponse, h.roomRedactor(room))
+		if err != nil {
+			return err
+		}
+		//parts come back redacted, and not at all in rooms whose patterns could match across chunks
+		if part != nil {
+			relayed := *message.msg
+			relayed.BurpRequestResponse = part
+			h.sendMessageToRoomByFeature(room, "chunkedTransfers", generateMessage(&relayed, message.sender, room.name), nil)
+		}
+		if complete == nil {
+			break
+		}
+		skipFeature := "chunkedTransfers"
+		if part == nil {
+			skipFeature = ""
+		}
+		//clients that can't put chunks back together get the whole message, which is also all history keeps
+		msg := NewBurpTCMessage()
+		msg.MessageType = chunk.MessageType
+		msg.BurpRequestResponse = complete
+		return h.shareRequest(room, generateMessage(msg, message.sender, room.name), skipFeature)
+	case "ADD_COMMENT_MESSAGE":
+		if message.msg.BurpRequestResponse == nil {
+			return newClientError(ErrorBadPayload, "comment message is missing its request")
+		}
+		commented, key, err := h.commentedRequest(room, message.msg.BurpRequestResponse)
+		if err != nil {
+			return err
+		}
+		requestWithComments := room.comments.getRequestWithComments(key)
+		if len(requestWithComments.Comments) == 0 {
+			//the key comes from the request as sent, so comments are found again whatever the redaction rules, but
+			//only the redacted request is kept and shown to the room
+			if redactor := h.roomRedactor(room); redactor.active() {
+				if commented, err = redactor.redactRequest(h.roomBlobs(room), commented); err != nil {
+					return err
+				}
+			}
+			requestWithComments = *commented
+			requestWithComments.removeComments()
+		}
+		commentId, err := generateCommentId()
+		if err != nil {
+			return err
+		}
+		requestWithComments.addComment(Comment{
+			Id:               commentId,
+			Comment:          message.msg.Data,
+			UserWhoCommented: message.sender.name,
+			TimeOfComment:    JavaJsonTime{time.Now()},
+		})
+		room.comments.setRequestWithComments(key, requestWithComments)
+		h.persistRoom(room)
+		h.announceComments(room, requestWithComments)
+	case "EDIT_COMMENT_MESSAGE":
+		fallthrough
+	case "DELETE_COMMENT_MESSAGE":
+		if message.msg.BurpRequestResponse == nil {
+			return newClientError(ErrorBadPayload, "comment message is missing its request")
+		}
+		_, key, err := h.commentedRequest(room, message.msg.BurpRequestResponse)
+		if err != nil {
+			return err
+		}
+		requestWithComments := room.comments.getRequestWithComments(key)
+		//edits carry "commentId:new comment", deletes carry just the comment id
+		commentData := strings.SplitN(message.msg.Data, ":", 2)
+		comment := requestWithComments.getComment(commentData[0])
+		if comment == nil {
+			return newClientError(ErrorBadPayload, "unknown comment %s", commentData[0])
+		}
+		if usernameFromClientName(comment.UserWhoCommented) != message.sender.username {
+			return newClientError(ErrorPermissionDenied, "%s cannot change comments from %s", message.sender.name, comment.UserWhoCommented)
+		}
+		if message.msg.MessageType == "EDIT_COMMENT_MESSAGE" {
+			if len(commentData) < 2 {
+				return newClientError(ErrorBadPayload, "comment edit is missing its text")
+			}
+			comment.Comment = commentData[1]
+			comment.TimeOfComment = JavaJsonTime{time.Now()}
+			room.comments.setRequestWithComments(key, requestWithComments)
+		} else {
+			requestWithComments.removeComment(commentData[0])
+			if len(requestWithComments.Comments) == 0 {
+				room.comments.removeRequestWithComments(key)
+			} else {
+				room.comments.setRequestWithComments(key, requestWithComments)
+			}
+		}
+		h.persistRoom(room)
+		h.announceComments(room, requestWithComments)
+	case "GET_COMMENTS_MESSAGE":
+		if message.msg.BurpRequestResponse != nil {
+			commented, key, err := h.commentedRequest(room, message.msg.BurpRequestResponse)
+			if err != nil {
+				return err
+			}
+			requestWithComments := room.comments.getRequestWithComments(key)
+			requestWithComments.Request = commented.Request
+			requestWithComments.HttpService = message.msg.BurpRequestResponse.HttpService
+			message.msg.MessageType = "COMMENTS_MESSAGE"
+			message.msg.BurpRequestResponse = &requestWithComments
+			message.sender.trySend(message)
+		} else {
+			return h.sendAllComments(room, message.sender)
+		}
+	case "SET_REDACTION_MESSAGE":
+		//empty data goes back to the server's rules
+		var redactor *Redactor
+		if len(message.msg.Data) > 0 {
+			var err error
+			if redactor, err = parseRedactionRules(message.msg.Data); err != nil {
+				return err
+			}
+		}
+		room.redactor = redactor
+		log.Printf("%s changed the redaction rules of room %s", message.sender.name, room.name)
+		h.persistRoom(room)
+		return h.sendRedactionRules(room, message)
+	case "GET_REDACTION_MESSAGE":
+		return h.sendRedactionRules(room, message)
+	case "GET_HISTORY_MESSAGE":
+		offset, limit := parseHistoryPageData(message.msg.Data)
+		log.Printf("%s requesting history of room %s from %d", message.sender.name, room.name, offset)
+		page := &HistoryPage{Offset: offset, Entries: []*HistoryEntry{}}
+		var err error
+		if h.history != nil && room.name != "server" {
+			if page, err = h.history.Page(room.name, offset, limit); err != nil {
+				return err
+			}
+		}
+		//clients that don't know about blobs get the bodies history refers to inline
+		if blobs := h.roomBlobs(room); blobs != nil && !message.sender.hasFeature("blobs") {
+			for _, entry := range page.Entries {
+				if entry.Message != nil && entry.Message.BurpRequestResponse != nil {
+					if entry.Message.BurpRequestResponse, err = blobs.loadBodies(entry.Message.BurpRequestResponse); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		pageBytes, err := json.Marshal(page)
+		if err != nil {
+			return err
+		}
+		message.msg.MessageType = "HISTORY_MESSAGE"
+		message.msg.Data = string(pageBytes)
+		message.sender.trySend(message)
+	case "GET_BLOB_MESSAGE":
+		//only bodies shared in the sender's room can be fetched
+		blob, err := h.roomBlobs(room).Get(message.msg.Data)
+		if os.IsNotExist(err) {
+			return newClientError(ErrorBlobNotFound, "blob %s does not exist", message.msg.Data)
+		} else if err != nil {
+			return err
+		}
+		message.msg.MessageType = "BLOB_MESSAGE"
+		message.msg.Blob = blob
+		message.sender.trySend(message)
+	default:
+		return newClientError(ErrorUnknownMessageType, "unknown message type %s", message.msg.MessageType)
+	}
+	return nil
+}
+
+// everything below expects the room lock to be held
+
+// returns a copy of the request with its body loaded from the room's blobs if it was sent by hash, and the key its comments are kept under
+func (h *Hub) commentedRequest(room *Room, burpReqResp *BurpRequestResponse) (*BurpRequestResponse, string, error) {
+	commented := *burpReqResp
+	var err error
+	if commented.Request, err = h.roomBlobs(room).loadBody(burpReqResp.Request, burpReqResp.RequestHash); err != nil {
+		return nil, "", err
+	}
+	return &commented, commentKey(&commented), nil
+}
+
+func (h *Hub) sendMessageToRoom(room *Room, message *Message) {
+	for _, roomMember := range room.clients {
+		if message.sender != nil && roomMember.name != message.sender.name {
+			if !roomMember.isGivenClientMuted(message.sender.name) {
+				roomMember.trySend(message)
+			}
+		}
+	}
+}
+
+// sends members with the feature one message and everyone else the other, members are skipped if theirs is nil
+func (h *Hub) sendMessageToRoomByFeature(room *Room, feature string, withFeature *Message, withoutFeature *Message) {
+	for _, roomMember := range room.clients {
+		if roomMember == withFeature.sender || roomMember.isGivenClientMuted(withFeature.sender.name) {
+			continue
+		}
+		if roomMember.hasFeature(feature) {
+			roomMember.trySend(withFeature)
+		} else if withoutFeature != nil {
+			roomMember.trySend(withoutFeature)
+		}
+	}
+}
+
+// records a shared request in history and sends it to the room, members with the blobs feature get its bodies by
+// hash. Members with skipFeature are left out, unless it is empty. Bodies sent by hash must have been shared in the room
+func (h *Hub) shareRequest(room *Room, message *Message, skipFeature string) error {
+	referencedMsg, inlineMsg := message, message
+	if message.msg.BurpRequestResponse != nil {
+		blobs := h.roomBlobs(room)
+		var referenced, inline *BurpRequestResponse
+		var err error
+		if blobs != nil {
+			referenced, inline, err = blobs.internBodies(message.msg.BurpRequestResponse)
+		} else {
+			//without a store every member gets the bodies inline
+			inline, err = blobs.loadBodies(message.msg.BurpRequestResponse)
+			referenced = inline
+		}
+		if err != nil {
+			return err
+		}
+		referencedCopy, inlineCopy := *message.msg, *message.msg
+		referencedCopy.BurpRequestResponse = referenced
+		inlineCopy.BurpRequestResponse = inline
+		referencedMsg = generateMessage(&referencedCopy, message.sender, room.name)
+		inlineMsg = generateMessage(&inlineCopy, message.sender, room.name)
+	}
+	//history keeps bodies in the blob store rather than once per entry
+	h.recordHistory(referencedMsg)
+	for _, roomMember := range room.clients {
+		if roomMember == message.sender || roomMember.isGivenClientMuted(message.sender.name) {
+			continue
+		}
+		if len(skipFeature) > 0 && roomMember.hasFeature(skipFeature) {
+			continue
+		}
+		if roomMember.hasFeature("blobs") {
+			roomMember.trySend(referencedMsg)
+		} else {
+			roomMember.trySend(inlineMsg)
+		}
+	}
+	return nil
+}
+
+func (h *Hub) sendMessageToAllInRoom(room *Room, message *Message) {
+	for _, roomMember := range room.clients {
+		roomMember.trySend(message)
+	}
+}
+
+func (h *Hub) updateRoomMembers(room *Room) {
+	if room.name == "server" || len(room.clients) == 0 {
+		return
+	}
+	msg := NewBurpTCMessage()
+	msg.MessageType = "NEW_MEMBER_MESSAGE"
+
+	keys := make([]string, 0, len(room.clients))
+	for k := range room.clients {
+		keys = append(keys, k)
+	}
+
+	msg.Data = strings.Join(keys, ",")
+	log.Printf("Current room (%s) members: %s", room.name, msg.Data)
+	h.sendMessageToAllInRoom(room, generateMessage(msg, nil, room.name))
+}
+
+func (h *Hub) announceRoles(room *Room) error {
+	rolesBytes, err := json.Marshal(room.getRoles())
+	if err != nil {
+		return err
+	}
+	msg := NewBurpTCMessage()
+	msg.MessageType = "ROLES_MESSAGE"
+	msg.Data = string(rolesBytes)
+	h.sendMessageToAllInRoom(room, generateMessage(msg, nil, room.name))
+	return nil
+}
+
+func (h *Hub) announceComments(room *Room, requestWithComments BurpRequestResponse) {
+	msg := NewBurpTCMessage()
+	msg.MessageType = "COMMENTS_MESSAGE"
+	msg.BurpRequestResponse = &requestWithComments
+	h.sendMessageToAllInRoom(room, generateMessage(msg, nil, room.name))
+}
+
+func (h *Hub) sendAllComments(room *Room, client *Client) error {
+	commentsBytes, err := json.Marshal(room.comments.getAllRequestsWithComments())
+	if err != nil {
+		return err
+	}
+	msg := NewBurpTCMessage()
+	msg.MessageType = "ALL_COMMENTS_MESSAGE"
+	msg.Data = string(commentsBytes)
+	client.trySend(generateMessage(msg, client, room.name))
+	return nil
+}
+
+func (h *Hub) recordHistory(message *Message) {
+	if h.history == nil || message.roomName == "server" {
+		return
+	}
+	senderName := ""
+	if message.sender != nil {
+		senderName = message.sender.name
+	}
+	if err := h.history.Append(message.roomName, senderName, message.msg); err != nil {
+		log.Printf("could not record history for room %s: %s", message.roomName, err)
+	}
+}
+
+func (h *Hub) persistRoom(room *Room) {
+	if h.roomStore == nil || !room.persistent {
+		return
+	}
+	if err := h.roomStore.SaveRoom(room); err != nil {
+		log.Printf("could not persist room %s: %s", room.name, err)
+	}
+}
+
+// replies with the rules the room's messages are redacted with. Must hold the room lock
+func (h *Hub) sendRedactionRules(room *Room, message *Message) error {
+	rulesBytes, err := json.Marshal(h.roomRedactor(room).getRules())
+	if err != nil {
+		return err
+	}
+	message.msg.Data = string(rulesBytes)
+	message.sender.trySend(message)
+	return nil
+}
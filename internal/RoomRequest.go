@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+const (
+	maxRoomNameLength = 64
+	//bcrypt ignores anything past 72 bytes so longer passwords are refused rather than silently truncated
+	maxRoomPasswordLength = 72
+)
+
+type RoomOptions struct {
+	Persistent bool `json:"persistent"`
+	Observer   bool `json:"observer"`
+}
+
+// RoomRequest is the Data payload of JOIN_ROOM_MESSAGE and ADD_ROOM_MESSAGE
+type RoomRequest struct {
+	Name     string      `json:"name"`
+	Password string      `json:"password"`
+	Options  RoomOptions `json:"options"`
+}
+
+// accepts the JSON payload or the legacy "name:password" format sent by older extensions, options are only read from JSON
+func parseRoomRequest(data string) (*RoomRequest, error) {
+	roomRequest := &RoomRequest{}
+	if strings.HasPrefix(strings.TrimSpace(data), "{") {
+		if err := json.Unmarshal([]byte(data), roomRequest); err != nil {
+			return nil, newClientError(ErrorBadPayload, "room request is not valid JSON")
+		}
+	} else {
+		roomData := strings.SplitN(data, ":", 2)
+		roomRequest.Name = roomData[0]
+		if len(roomData) > 1 {
+			roomRequest.Password = roomData[1]
+		}
+	}
+	if len(roomRequest.Name) == 0 {
+		return nil, newClientError(ErrorBadPayload, "room name cannot be empty")
+	}
+	if len(roomRequest.Password) > maxRoomPasswordLength {
+		return nil, newClientError(ErrorBadPayload, "room password cannot be longer than %d bytes", maxRoomPasswordLength)
+	}
+	return roomRequest, nil
+}
+
+// new room names end up in the comma separated GET_ROOMS_MESSAGE list so they are held to stricter rules
+func validateNewRoomName(roomName string) error {
+	if len(roomName) > maxRoomNameLength {
+		return newClientError(ErrorBadPayload, "room name cannot be longer than %d characters", maxRoomNameLength)
+	}
+	if strings.TrimSpace(roomName) != roomName {
+		return newClientError(ErrorBadPayload, "room name cannot start or end with whitespace")
+	}
+	if strings.ContainsAny(roomName, ",:") {
+		return newClientError(ErrorBadPayload, "room name cannot contain ',' or ':'")
+	}
+	if roomName == "server" {
+		return newClientError(ErrorBadPayload, "room name server is reserved for the lobby")
+	}
+	return nil
+}
@@ -0,0 +1,180 @@
+package internal
+
+import (
+	"encoding/json"
+	"go.etcd.io/bbolt"
+	"log"
+	"sync"
+	"time"
+)
+
+var roomsBucket = []byte("rooms")
+
+type persistedRoom struct {
+	Name         string                         `json:"name"`
+	Created      time.Time                      `json:"created"`
+	PasswordHash []byte                         `json:"passwordHash"`
+	Scope        string                         `json:"scope"`
+	Owner        string                         `json:"owner"`
+	Comments     map[string]BurpRequestResponse `json:"comments"`
+	Roles        map[string]string              `json:"roles"`
+	Bans         map[string]bool                `json:"bans"`
+	Redaction    *RedactionRules                `json:"redaction,omitempty"`
+}
+
+// RoomStore writes rooms on its own goroutine so rooms never wait on the disk while holding their lock
+type RoomStore struct {
+	db *bbolt.DB
+	//guards pending, the latest snapshot of each room waiting to be written, nil for rooms to delete
+	lock    sync.Mutex
+	pending map[string][]byte
+	wake    chan struct{}
+	quit    chan struct{}
+	stopped chan struct{}
+}
+
+func NewRoomStore(path string) (*RoomStore, error) {
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Update(func(tx *bbolt.Tx) error {
+		_, err := tx.CreateBucketIfNotExists(roomsBucket)
+		return err
+	}); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+	store := &RoomStore{
+		db:      db,
+		pending: make(map[string][]byte),
+		wake:    make(chan struct{}, 1),
+		quit:    make(chan struct{}),
+		stopped: make(chan struct{}),
+	}
+	go store.writeLoop()
+	return store, nil
+}
+
+// writes queued rooms until the store is closed
+func (r *RoomStore) writeLoop() {
+	defer close(r.stopped)
+	for {
+		select {
+		case <-r.wake:
+			r.flush()
+		case <-r.quit:
+			r.flush()
+			return
+		}
+	}
+}
+
+func (r *RoomStore) flush() {
+	r.lock.Lock()
+	pending := r.pending
+	r.pending = make(map[string][]byte)
+	r.lock.Unlock()
+	if len(pending) == 0 {
+		return
+	}
+	if err := r.db.Update(func(tx *bbolt.Tx) error {
+		bucket := tx.Bucket(roomsBucket)
+		for roomName, roomBytes := range pending {
+			var err error
+			if roomBytes == nil {
+				err = bucket.Delete([]byte(roomName))
+			} else {
+				err = bucket.Put([]byte(roomName), roomBytes)
+			}
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		log.Printf("could not save %d rooms: %s", len(pending), err)
+	}
+}
+
+// replaces anything already waiting for the room, only its latest state matters
+func (r *RoomStore) queue(roomName string, roomBytes []byte) {
+	r.lock.Lock()
+	r.pending[roomName] = roomBytes
+	r.lock.Unlock()
+	select {
+	case r.wake <- struct{}{}:
+	default:
+	}
+}
+
+// snapshots the room to be written once the caller lets go of it. Must hold the room lock
+func (r *RoomStore) SaveRoom(room *Room) error {
+	roomBytes, err := json.Marshal(&persistedRoom{
+		Name:         room.name,
+		Created:      room.created,
+		PasswordHash: room.passwordHash,
+		Scope:        room.scope,
+		Owner:        room.owner,
+		Comments:     room.comments.requestsWithComments,
+		Roles:        room.roles,
+		Bans:         room.bans,
+		Redaction:    room.getRedactionRules(),
+	})
+	if err != nil {
+		return err
+	}
+	r.queue(room.name, roomBytes)
+	return nil
+}
+
+func (r *RoomStore) DeleteRoom(roomName string) error {
+	r.queue(roomName, nil)
+	return nil
+}
+
+func (r *RoomStore) LoadRooms() ([]*Room, error) {
+	var rooms []*Room
+	err := r.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(roomsBucket).ForEach(func(_, roomBytes []byte) error {
+			stored := persistedRoom{}
+			if err := json.Unmarshal(roomBytes, &stored); err != nil {
+				return err
+			}
+			comments := NewComments()
+			for key, requestWithComments := range stored.Comments {
+				comments.setRequestWithComments(key, requestWithComments)
+			}
+			if stored.Roles == nil {
+				stored.Roles = make(map[string]string)
+			}
+			if stored.Bans == nil {
+				stored.Bans = make(map[string]bool)
+			}
+			room := newRoom(stored.Name, stored.PasswordHash, true)
+			room.created = stored.Created
+			room.scope = stored.Scope
+			room.owner = stored.Owner
+			room.comments = comments
+			room.roles = stored.Roles
+			room.bans = stored.Bans
+			if stored.Redaction != nil {
+				redactor, err := NewRedactor(stored.Redaction)
+				if err != nil {
+					return err
+				}
+				room.redactor = redactor
+			}
+			rooms = append(rooms, room)
+			return nil
+		})
+	})
+	return rooms, err
+}
+
+// writes anything still queued before closing the database
+func (r *RoomStore) Close() error {
+	close(r.quit)
+	<-r.stopped
+	return r.db.Close()
+}
@@ -1,36 +1,156 @@
 package internal
 
 import (
-	"errors"
+	"encoding/json"
 	"fmt"
 	"github.com/fasthttp/websocket"
+	"golang.org/x/crypto/bcrypt"
 	"log"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 var hub *Hub
 
+// how long a room that isn't persistent is kept once its last member leaves, so members who lost their connection
+// can rejoin it with its history intact
+const emptyRoomLifetime = 10 * time.Minute
+
+// how often the user list is checked for accounts removed or reset from the command line
+const userReloadInterval = 5 * time.Second
+
+// Hub registers clients, routes their messages to rooms and moves clients between rooms.
+// Everything else happens on each room's own goroutine so busy rooms don't hold up quiet ones.
 type Hub struct {
+	//updated atomically, kept first so it stays 64-bit aligned
+	recoveredPanics uint64
+	//guards the rooms map, only the hub goroutine changes it and it is always taken before a room lock
+	roomsLock        sync.RWMutex
 	rooms            map[string]*Room
 	messages         chan *Message
 	register         chan *Client
 	unregister       chan *Client
+	emptyRooms       chan *Room
 	serverPassword   string
 	shortenerService *ShortenedUrls
+	history          *HistoryStore
+	roomStore        *RoomStore
+	blobs            *BlobStore
+	messageRateLimit int
+	//messages smaller than this are sent uncompressed even when the client negotiated compression
+	compressionThreshold int
+	//largest websocket message accepted from a client, 0 for no limit
+	maxMessageSize int64
+	//redaction rules for rooms that haven't set their own
+	redactor *Redactor
 }
 
-func NewHub(serverPassword string) *Hub {
+// minimum room role needed to send each message type, anything not listed is open to every room member
+var requiredRoles = map[string]string{
+	"SET_SCOPE_MESSAGE":      RoleMember,
+	"COOKIE_MESSAGE":         RoleMember,
+	"SCAN_ISSUE_MESSAGE":     RoleMember,
+	"REPEATER_MESSAGE":       RoleMember,
+	"INTRUDER_MESSAGE":       RoleMember,
+	"BURP_MESSAGE":           RoleMember,
+	"CHUNK_MESSAGE":          RoleMember,
+	"ADD_COMMENT_MESSAGE":    RoleMember,
+	"EDIT_COMMENT_MESSAGE":   RoleMember,
+	"DELETE_COMMENT_MESSAGE": RoleMember,
+	"PROMOTE_MESSAGE":        RoleOwner,
+	"DEMOTE_MESSAGE":         RoleOwner,
+	"KICK_MESSAGE":           RoleOwner,
+	"BAN_MESSAGE":            RoleOwner,
+	"UNBAN_MESSAGE":          RoleOwner,
+	"SET_REDACTION_MESSAGE":  RoleOwner,
+}
+
+// message types handled by the hub goroutine
+var hubMessageTypes = map[string]bool{
+	"HELLO_MESSAGE":        true,
+	"JOIN_ROOM_MESSAGE":    true,
+	"LEAVE_ROOM_MESSAGE":   true,
+	"ADD_ROOM_MESSAGE":     true,
+	"DELETE_ROOM_MESSAGE":  true,
+	"KICK_MESSAGE":         true,
+	"BAN_MESSAGE":          true,
+	"GET_ROOMS_MESSAGE":    true,
+	"GET_CONFIG_MESSAGE":   true,
+	"SHORTEN_LINK_MESSAGE": true,
+	"GET_LINKS_MESSAGE":    true,
+	"GET_LINK_MESSAGE":     true,
+	"REVOKE_LINK_MESSAGE":  true,
+}
+
+// message types handled by the sender's room goroutine. Types only the server sends, like NEW_MEMBER_MESSAGE, are
+// left out so clients can't forge them
+var roomMessageTypes = map[string]bool{
+	"SET_SCOPE_MESSAGE":      true,
+	"GET_SCOPE_MESSAGE":      true,
+	"MUTE_MESSAGE":           true,
+	"UNMUTE_MESSAGE":         true,
+	"COOKIE_MESSAGE":         true,
+	"SCAN_ISSUE_MESSAGE":     true,
+	"REPEATER_MESSAGE":       true,
+	"INTRUDER_MESSAGE":       true,
+	"BURP_MESSAGE":           true,
+	"CHUNK_MESSAGE":          true,
+	"GET_HISTORY_MESSAGE":    true,
+	"GET_BLOB_MESSAGE":       true,
+	"ADD_COMMENT_MESSAGE":    true,
+	"EDIT_COMMENT_MESSAGE":   true,
+	"DELETE_COMMENT_MESSAGE": true,
+	"GET_COMMENTS_MESSAGE":   true,
+	"PROMOTE_MESSAGE":        true,
+	"DEMOTE_MESSAGE":         true,
+	"GET_ROLES_MESSAGE":      true,
+	"UNBAN_MESSAGE":          true,
+	"SET_REDACTION_MESSAGE":  true,
+	"GET_REDACTION_MESSAGE":  true,
+}
+
+func NewHub(serverPassword string, history *HistoryStore, roomStore *RoomStore, blobs *BlobStore) *Hub {
 	hub := &Hub{
 		register:       make(chan *Client),
 		unregister:     make(chan *Client),
+		emptyRooms:     make(chan *Room),
 		rooms:          make(map[string]*Room),
 		messages:       make(chan *Message, 1024),
 		serverPassword: serverPassword,
+		history:        history,
+		roomStore:      roomStore,
+		blobs:          blobs,
 	}
 
 	//initialize server lobby room
-	hub.rooms["server"] = NewRoom("server", "")
+	lobby, _ := NewRoom("server", "")
+	hub.addRoom(lobby)
+
+	//reload persistent rooms from the previous run
+	var persistedRoomNames []string
+	if roomStore != nil {
+		persistedRooms, err := roomStore.LoadRooms()
+		if err != nil {
+			log.Fatalf("could not load persistent rooms: %s", err)
+		}
+		for _, room := range persistedRooms {
+			log.Printf("Restoring persistent room %s", room.name)
+			hub.addRoom(room)
+			persistedRoomNames = append(persistedRoomNames, room.name)
+		}
+	}
+	//every other room ended with the previous run, even if it never got to clean up after itself
+	if history != nil {
+		history.RemoveAllExcept(persistedRoomNames)
+	}
+	if blobs != nil {
+		blobs.RemoveAllRoomsExcept(persistedRoomNames)
+	}
 
 	go hub.eventLoop()
 
@@ -41,71 +161,141 @@ func (h *Hub) eventLoop() {
 	for {
 		select {
 		case newSubscription := <-h.register:
-			log.Printf("Registering new client %v", newSubscription)
+			log.Printf("Registering new client %v", newSubscription.name)
 			//when registering we add them to the server lobby default room
-			h.rooms["server"].clients[newSubscription.name] = newSubscription
+			lobby := h.rooms["server"]
+			lobby.lock.Lock()
+			lobby.clients[newSubscription.name] = newSubscription
+			lobby.lock.Unlock()
 		case leavingSubscription := <-h.unregister:
-			log.Printf("Client %v is leaving", leavingSubscription)
-			//get current room members
-			currentRoomMembers := h.rooms[leavingSubscription.room]
-			//if the room exists
-			if currentRoomMembers != nil {
-				//if the current room members includes the leaving client
-				if _, ok := currentRoomMembers.clients[leavingSubscription.name]; ok {
-					//remove the client from the room
-					delete(currentRoomMembers.clients, leavingSubscription.name)
-					//close the clients send channel so no more messages are sent to them
-					close(leavingSubscription.sendChannel)
-					//if the room has no more members and isn't the server lobby, delete the room
-					if len(currentRoomMembers.clients) == 0 && currentRoomMembers.name != "server" {
-						delete(h.rooms, currentRoomMembers.name)
-					} else {
-						h.updateRoomMembers(currentRoomMembers.name)
-					}
-				}
-			}
+			log.Printf("Client %v is leaving", leavingSubscription.name)
+			h.removeClient(leavingSubscription)
 		case message := <-h.messages:
-			if err := h.parseMessage(message); err != nil {
-				log.Printf("Error parsing message: %s", err)
+			h.handleMessage(message, h.parseMessage)
+			//let the reader know it can route its next message
+			close(message.done)
+		case emptyRoom := <-h.emptyRooms:
+			emptyRoom.lock.Lock()
+			expired := len(emptyRoom.clients) == 0 && !emptyRoom.emptySince.IsZero() && time.Since(emptyRoom.emptySince) >= emptyRoomLifetime
+			emptyRoom.lock.Unlock()
+			if expired {
+				log.Printf("deleting room %s, it has been empty for %s", emptyRoom.name, emptyRoomLifetime)
+				h.deleteRoom(emptyRoom)
+				h.announceNewRooms()
 			}
 		}
 	}
 }
 
-func (h *Hub) sendMessageToClient(message *Message) {
-	select {
-	case message.sender.sendChannel <- message:
-		log.Printf("Sent message %v to client %s", message, message.sender.name)
-	default:
-		h.unregister <- message.sender
+// sends room messages to the sender's room goroutine and everything else to the hub
+func (h *Hub) route(message *Message) {
+	if message.err == nil && !hubMessageTypes[message.msg.MessageType] && !roomMessageTypes[message.msg.MessageType] {
+		message.err = newClientError(ErrorUnknownMessageType, "unknown message type %s", message.msg.MessageType)
 	}
+	if message.err == nil && roomMessageTypes[message.msg.MessageType] {
+		if room := h.getRoom(message.roomName); room != nil && room.enqueue(message) {
+			return
+		}
+		message.err = newClientError(ErrorRoomNotFound, "room %s does not exist", message.roomName)
+	}
+	//the client's room messages go first, so nothing it shared is dropped by it leaving or moving rooms
+	message.sender.roomMessages.Wait()
+	h.prepareRoomPassword(message)
+	//wait for hub messages to finish so a client's next message is routed to the room it just moved to
+	message.done = make(chan struct{})
+	h.messages <- message
+	<-message.done
 }
 
-func (h *Hub) sendMessageToRoom(message *Message) {
+// bcrypt is slow on purpose, so room passwords are checked and hashed here on the sender's reader goroutine
+// rather than holding up the hub for every other client
+func (h *Hub) prepareRoomPassword(message *Message) {
+	if message.err != nil || (message.msg.MessageType != "JOIN_ROOM_MESSAGE" && message.msg.MessageType != "ADD_ROOM_MESSAGE") {
+		return
+	}
+	roomRequest, err := parseRoomRequest(message.msg.Data)
+	if err != nil || len(roomRequest.Password) == 0 {
+		return
+	}
+	room := h.getRoom(roomRequest.Name)
+	if message.msg.MessageType == "JOIN_ROOM_MESSAGE" {
+		if room != nil && room.hasPassword() && room.checkPassword(roomRequest.Password) {
+			message.passwordRoom = room
+		}
+	} else if room == nil {
+		if message.passwordHash, err = bcrypt.GenerateFromPassword([]byte(roomRequest.Password), bcrypt.DefaultCost); err != nil {
+			log.Printf("could not hash password of new room %s: %s", roomRequest.Name, err)
+			message.err = newClientError(ErrorInternal, "could not set the password of room %s", roomRequest.Name)
+		}
+	}
+}
 
-	for _, roomMember := range h.rooms[message.roomName].clients {
-		if message.sender != nil && roomMember.name != message.sender.name {
-			if !roomMember.isGivenClientMuted(message.sender.name) {
-				select {
-				case roomMember.sendChannel <- message:
-					log.Printf("Sent message %v to client %s", message, roomMember.name)
-				default:
-					h.unregister <- roomMember
+// handles a single message, recovering from any panic so one bad message can't take down every room
+func (h *Hub) handleMessage(message *Message, parse func(*Message) error) {
+	defer func() {
+		if r := recover(); r != nil {
+			atomic.AddUint64(&h.recoveredPanics, 1)
+			log.Printf("Recovered from panic handling message %v from client %v: %v\n%s", message.msg, message.sender, r, debug.Stack())
+			//the sender may be what broke, so don't let replying to them panic again
+			defer func() {
+				if r := recover(); r != nil {
+					log.Printf("could not report panic to client %v: %v", message.sender, r)
 				}
-			}
+			}()
+			h.sendError(message, newClientError(ErrorInternal, "the server failed handling this message"))
 		}
+	}()
+	//anything still arriving from a client that was already removed is dropped
+	if message.sender != nil && message.sender.isClosed() {
+		return
+	}
+	senderName := ""
+	if message.sender != nil {
+		senderName = message.sender.name
+	}
+	log.Printf("Got message type: %s from client: %s to room %s", message.msg.MessageType, senderName, message.roomName)
+	if err := parse(message); err != nil {
+		log.Printf("Error parsing message: %s", err)
+		h.sendError(message, err)
+	}
+}
+
+func (h *Hub) RecoveredPanics() uint64 {
+	return atomic.LoadUint64(&h.recoveredPanics)
+}
+
+// safe to call from any goroutine, nil if the room doesn't exist
+func (h *Hub) getRoom(roomName string) *Room {
+	h.roomsLock.RLock()
+	defer h.roomsLock.RUnlock()
+	return h.rooms[roomName]
+}
+
+func (h *Hub) RoomStats() map[string]*RoomStats {
+	h.roomsLock.RLock()
+	defer h.roomsLock.RUnlock()
+	stats := make(map[string]*RoomStats, len(h.rooms))
+	for roomName, room := range h.rooms {
+		stats[roomName] = room.getStats()
 	}
+	return stats
 }
 
-func (h *Hub) Register(conn *websocket.Conn, clientName string) *Client {
+// wireConn counts the bytes written to the client's connection, it is nil when the server isn't using TLS
+// verified is true when the client proved its username with a user account or client certificate
+func (h *Hub) Register(conn *websocket.Conn, wireConn *countingConn, clientName string, verified bool) *Client {
 	userNumber, err := generateRandomUserNumber()
 	if err != nil {
 		log.Fatalln("Why are we not generating random numbers")
 	}
 	client := &Client{
 		conn:         conn,
+		wireConn:     wireConn,
 		room:         "server",
 		name:         fmt.Sprintf("%s#%d", clientName, userNumber),
+		username:     clientName,
+		verified:     verified,
+		binary:       conn.Subprotocol() == WireProtocolV2,
 		mutedClients: []string{},
 		sendChannel:  make(chan *Message, 1024),
 	}
@@ -115,169 +305,417 @@ func (h *Hub) Register(conn *websocket.Conn, clientName string) *Client {
 	return client
 }
 
+// handles the messages that create, delete or move between rooms, always on the hub goroutine
 func (h *Hub) parseMessage(message *Message) error {
-	log.Printf("Got message type: %s from client: %v to room %s", message.msg.MessageType, message.sender, message.roomName)
+	if message.err != nil {
+		return message.err
+	}
 	switch message.msg.MessageType {
-	case "NEW_MEMBER_MESSAGE":
-		if h.rooms[message.roomName].clients != nil {
-			for _, roomMember := range h.rooms[message.roomName].clients {
-				log.Printf("Sending message type %s to client %s", message.msg.MessageType, roomMember.name)
-				select {
-				case roomMember.sendChannel <- message:
-				default:
-					h.unregister <- roomMember
-				}
-			}
+	case "HELLO_MESSAGE":
+		clientHello, err := parseClientHello(message.msg.Data)
+		if err != nil {
+			return err
+		}
+		log.Printf("%s speaks protocol version %d with features %v", message.sender.name, clientHello.Version, clientHello.Features)
+		message.sender.setHello(clientHello)
+		helloBytes, err := json.Marshal(h.serverHello())
+		if err != nil {
+			return err
 		}
-	case "SET_SCOPE_MESSAGE":
-		log.Printf("received new scope from %s", message.sender.name)
-		h.rooms[message.sender.room].scope = message.msg.Data
-	case "GET_SCOPE_MESSAGE":
-		log.Printf("%s requesting scope", message.sender.name)
-		message.msg.Data = h.rooms[message.sender.room].scope
-		h.sendMessageToClient(message)
+		message.msg.Data = string(helloBytes)
+		message.sender.trySend(message)
 	case "JOIN_ROOM_MESSAGE":
-		roomTargetData := strings.Split(message.msg.Data, ":")
-		roomServerPassword := h.rooms[roomTargetData[0]].password
-		if len(roomServerPassword) > 0 {
-			if roomServerPassword == roomTargetData[1] {
-				h.clientRoomChangeHandler(message.sender, roomTargetData[0])
+		roomRequest, err := parseRoomRequest(message.msg.Data)
+		if err != nil {
+			return err
+		}
+		targetRoom, ok := h.rooms[roomRequest.Name]
+		if !ok {
+			return newClientError(ErrorRoomNotFound, "room %s does not exist", roomRequest.Name)
+		}
+		targetRoom.lock.Lock()
+		banned := targetRoom.isBanned(message.sender.username)
+		targetRoom.lock.Unlock()
+		if banned {
+			return newClientError(ErrorPermissionDenied, "%s is banned from room %s", message.sender.username, targetRoom.name)
+		} else if targetRoom.hasPassword() {
+			//the password was checked against this room before it reached the hub
+			if message.passwordRoom == targetRoom {
+				h.joinRoom(message.sender, targetRoom, roomRequest.Options.Observer)
 				//change response message type so client knows auth succeeded
 				message.msg.MessageType = "GOOD_PASSWORD_MESSAGE"
 				//send to client
-				h.sendMessageToClient(message)
+				message.sender.trySend(message)
 			} else {
 				//bad password
 				message.msg.MessageType = "BAD_PASSWORD_MESSAGE"
-				h.sendMessageToClient(message)
+				message.sender.trySend(message)
 			}
 		} else {
-			h.clientRoomChangeHandler(message.sender, roomTargetData[0])
+			h.joinRoom(message.sender, targetRoom, roomRequest.Options.Observer)
 		}
 	case "LEAVE_ROOM_MESSAGE":
-		log.Printf("%s leaving room: %s", message.sender.name, message.sender.room)
-		h.clientRoomChangeHandler(message.sender, "server")
+		log.Printf("%s leaving room: %s", message.sender.name, message.sender.getRoom())
+		h.clientRoomChangeHandler(message.sender, h.rooms["server"])
 	case "ADD_ROOM_MESSAGE":
-		roomTargetData := strings.Split(message.msg.Data, ":")
-		//log.Printf("creating new room: %s with password : %s", roomTargetData[0], roomTargetData[1])
-		if _, ok := h.rooms[roomTargetData[0]]; ok {
+		roomRequest, err := parseRoomRequest(message.msg.Data)
+		if err != nil {
+			return err
+		}
+		if err := validateNewRoomName(roomRequest.Name); err != nil {
+			return err
+		}
+		if _, ok := h.rooms[roomRequest.Name]; ok {
 			message.msg.MessageType = "ROOM_EXISTS_MESSAGE"
-			h.sendMessageToClient(message)
+			message.sender.trySend(message)
 		} else {
-			if len(roomTargetData) > 1 {
-				h.rooms[roomTargetData[0]] = NewRoom(roomTargetData[0], roomTargetData[1])
-			} else {
-				h.rooms[roomTargetData[0]] = NewRoom(roomTargetData[0], "")
+			//a persistent room outlives its owner's connection, so its owner has to be someone the server can vouch for
+			if roomRequest.Options.Persistent && !message.sender.verified {
+				return newClientError(ErrorPermissionDenied, "persistent rooms need a user account or client certificate")
 			}
-			h.clientRoomChangeHandler(message.sender, roomTargetData[0])
-			h.announceNewRooms()
-		}
-	case "MUTE_MESSAGE":
-		if message.msg.Data == "All" {
-			for _, roomMember := range h.rooms[message.sender.room].clients {
-				if roomMember.name != message.sender.name {
-					message.sender.mutedClients = append(message.sender.mutedClients, roomMember.name)
-				}
+			if len(roomRequest.Password) > 0 && message.passwordHash == nil {
+				//the room existed when the password would have been hashed but has since been deleted
+				return newClientError(ErrorRoomNotFound, "room %s changed while its password was being set, try again", roomRequest.Name)
 			}
-		} else {
-			if message.msg.Data != message.sender.name {
-				message.sender.mutedClients = append(message.sender.mutedClients, message.msg.Data)
+			newRoom := newRoom(roomRequest.Name, message.passwordHash, false)
+			newRoom.owner = message.sender.username
+			//persistent rooms survive restarts and being left empty
+			if roomRequest.Options.Persistent && h.roomStore != nil {
+				newRoom.persistent = true
+				h.persistRoom(newRoom)
 			}
+			h.addRoom(newRoom)
+			h.clientRoomChangeHandler(message.sender, newRoom)
+			h.announceNewRooms()
 		}
-		log.Printf("%s muted these clients %s", message.sender.name, message.sender.mutedClients)
-	case "UNMUTE_MESSAGE":
-		if message.msg.Data == "All" {
-			for _, roomMember := range h.rooms[message.sender.room].clients {
-				if roomMember.name != message.sender.name {
-					message.sender.mutedClients = remove(message.sender.mutedClients, index(message.sender.mutedClients, roomMember.name))
-				}
-			}
-		} else {
-			if message.msg.Data != message.sender.name {
-				message.sender.mutedClients = remove(message.sender.mutedClients, index(message.sender.mutedClients, message.msg.Data))
-			}
+	case "DELETE_ROOM_MESSAGE":
+		roomName := message.msg.Data
+		if len(roomName) == 0 {
+			roomName = message.sender.getRoom()
+		}
+		room, ok := h.rooms[roomName]
+		if !ok {
+			return newClientError(ErrorRoomNotFound, "room %s does not exist", roomName)
+		}
+		room.lock.Lock()
+		isOwner := room.hasRole(message.sender, RoleOwner)
+		roomMembers := room.getClients()
+		room.lock.Unlock()
+		if roomName == "server" || !isOwner {
+			return newClientError(ErrorPermissionDenied, "only owners can delete room %s", roomName)
+		}
+		log.Printf("%s deleting room: %s", message.sender.name, roomName)
+		//move everyone left in the room back to the lobby
+		for _, roomMember := range roomMembers {
+			h.clientRoomChangeHandler(roomMember, h.rooms["server"])
+		}
+		h.deleteRoom(room)
+		h.announceNewRooms()
+	case "KICK_MESSAGE":
+		fallthrough
+	case "BAN_MESSAGE":
+		room, ok := h.rooms[message.sender.getRoom()]
+		if !ok {
+			return newClientError(ErrorRoomNotFound, "room %s does not exist", message.sender.getRoom())
+		}
+		room.lock.Lock()
+		targetUsername, err := h.banOrKick(room, message)
+		room.lock.Unlock()
+		if err != nil {
+			return err
 		}
-		log.Printf("%s unmuted %s", message.sender.name, message.msg.Data)
+		h.removeUserFromRoom(room, targetUsername)
 	case "GET_ROOMS_MESSAGE":
-
-		rooms := h.rooms
-		keys := make([]string, 0, len(rooms))
-		for k := range rooms {
-			if k != "server" {
-				keys = append(keys, k+"::"+strconv.FormatBool(len(rooms[k].password) > 0))
+		message.msg.Data = h.getRoomList()
+		message.sender.trySend(message)
+	case "GET_CONFIG_MESSAGE":
+		if h.shortenerService != nil {
+			apiKey, err := h.shortenerService.getUrlShortenerApiKey()
+			if err != nil {
+				log.Printf("could not load shortener API key: %s", err)
 			}
+			message.msg.Data = apiKey
 		}
-		message.msg.Data = strings.Join(keys, ",")
-
-		if message.sender == nil {
-			//server announcing new rooms to lobby
-			for _, lobbyMember := range h.rooms["server"].clients {
-				lobbyMember.sendChannel <- message
+		message.sender.trySend(message)
+	case "SHORTEN_LINK_MESSAGE", "GET_LINKS_MESSAGE", "GET_LINK_MESSAGE", "REVOKE_LINK_MESSAGE":
+		if h.shortenerService == nil {
+			return newClientError(ErrorShortenerDisabled, "the URL shortener is not enabled on this server")
+		}
+		//links shared from a room are redacted like the room's messages and can refer to the room's blobs
+		redactor := h.redactor
+		var blobs *BlobStore
+		room := h.getRoom(message.sender.getRoom())
+		if room != nil {
+			room.lock.Lock()
+			redactor = h.roomRedactor(room)
+			room.lock.Unlock()
+			blobs = h.roomBlobs(room)
+		}
+		ownsRoom := func(link *ShortenedLink) bool {
+			room := h.getRoom(link.Room)
+			if !link.sharedFrom(room) {
+				return false
 			}
-		} else {
-			h.sendMessageToClient(message)
+			room.lock.Lock()
+			defer room.lock.Unlock()
+			return room.roleOf(message.sender.username) == RoleOwner
 		}
-	case "GET_CONFIG_MESSAGE":
-		if h.shortenerService != nil {
-			message.msg.Data = h.shortenerService.apiKey
+		if err := h.shortenerService.parseLinkMessage(message, room, redactor, blobs, ownsRoom); err != nil {
+			return err
 		}
-		h.sendMessageToClient(message)
-	case "COOKIE_MESSAGE":
-		fallthrough
-	case "SCAN_ISSUE_MESSAGE":
-		fallthrough
-	case "REPEATER_MESSAGE":
-		fallthrough
-	case "INTRUDER_MESSAGE":
-		fallthrough
-	case "BURP_MESSAGE":
-		h.sendMessageToRoom(message)
+		message.sender.trySend(message)
 	default:
-		return errors.New("ERROR: unknown message type")
+		return newClientError(ErrorUnknownMessageType, "unknown message type %s", message.msg.MessageType)
 	}
 	return nil
 }
 
+// checks and records a kick or ban, returning the username to remove from the room. Must hold the room lock
+func (h *Hub) banOrKick(room *Room, message *Message) (string, error) {
+	if requiredRole := requiredRoles[message.msg.MessageType]; !room.hasRole(message.sender, requiredRole) {
+		return "", newClientError(ErrorPermissionDenied, "%s requires the %s role in room %s", message.msg.MessageType, requiredRole, room.name)
+	}
+	//bans may name a connected client or the account of someone who already left
+	targetUsername := usernameFromClientName(message.msg.Data)
+	if targetClient, ok := room.clients[message.msg.Data]; ok {
+		targetUsername = targetClient.username
+	} else if message.msg.MessageType == "KICK_MESSAGE" {
+		return "", newClientError(ErrorBadPayload, "%s is not in room %s", message.msg.Data, room.name)
+	}
+	if targetUsername == room.owner || targetUsername == message.sender.username {
+		return "", newClientError(ErrorPermissionDenied, "%s cannot remove %s", message.sender.name, message.msg.Data)
+	}
+	if message.msg.MessageType == "BAN_MESSAGE" {
+		log.Printf("%s banned %s from room %s", message.sender.name, targetUsername, room.name)
+		room.bans[targetUsername] = true
+		h.persistRoom(room)
+	}
+	return targetUsername, nil
+}
+
+func (h *Hub) getRoomList() string {
+	h.roomsLock.RLock()
+	defer h.roomsLock.RUnlock()
+	keys := make([]string, 0, len(h.rooms))
+	for k := range h.rooms {
+		if k != "server" {
+			keys = append(keys, k+"::"+strconv.FormatBool(h.rooms[k].hasPassword()))
+		}
+	}
+	sort.Strings(keys)
+	return strings.Join(keys, ",")
+}
+
 func (h *Hub) announceNewRooms() {
 	msg := NewBurpTCMessage()
 	msg.MessageType = "GET_ROOMS_MESSAGE"
-	h.messages <- generateMessage(msg, nil, "server")
+	msg.Data = h.getRoomList()
+	//server announcing new rooms to lobby
+	lobby := h.rooms["server"]
+	lobby.lock.Lock()
+	defer lobby.lock.Unlock()
+	h.sendMessageToAllInRoom(lobby, generateMessage(msg, nil, "server"))
 }
 
-func (h *Hub) updateRoomMembers(roomName string) {
-	if roomName == "server" {
-		return
+func (h *Hub) removeClient(leavingClient *Client) {
+	//get current room members
+	currentRoomMembers := h.rooms[leavingClient.getRoom()]
+	//if the room exists
+	if currentRoomMembers != nil {
+		currentRoomMembers.lock.Lock()
+		//if the current room members includes the leaving client
+		_, ok := currentRoomMembers.clients[leavingClient.name]
+		if ok {
+			//remove the client from the room
+			delete(currentRoomMembers.clients, leavingClient.name)
+			delete(currentRoomMembers.observers, leavingClient.name)
+			currentRoomMembers.abandonTransfers(leavingClient)
+			h.updateRoomMembers(currentRoomMembers)
+		}
+		empty := ok && currentRoomMembers.markIfEmpty()
+		currentRoomMembers.lock.Unlock()
+		//if the room has no more members and isn't the server lobby or persistent, delete the room once it has been empty for a while
+		if empty && currentRoomMembers.name != "server" && !currentRoomMembers.persistent {
+			h.deleteWhenEmpty(currentRoomMembers)
+		}
 	}
-	msg := NewBurpTCMessage()
-	msg.MessageType = "NEW_MEMBER_MESSAGE"
+	//close the clients send channel so no more messages are sent to them
+	leavingClient.close()
+}
 
-	keys := make([]string, 0, len(h.rooms[roomName].clients))
-	for k := range h.rooms[roomName].clients {
-		keys = append(keys, k)
+// sends every connection of the user back to the lobby and tells them why
+func (h *Hub) removeUserFromRoom(room *Room, username string) {
+	room.lock.Lock()
+	roomMembers := room.getClients()
+	room.lock.Unlock()
+	for _, roomMember := range roomMembers {
+		if roomMember.username == username {
+			log.Printf("removing %s from room %s", roomMember.name, room.name)
+			h.clientRoomChangeHandler(roomMember, h.rooms["server"])
+			msg := NewBurpTCMessage()
+			msg.MessageType = "KICKED_MESSAGE"
+			msg.Data = room.name
+			roomMember.trySend(generateMessage(msg, roomMember, "server"))
+		}
 	}
+}
 
-	if len(keys) > 0 {
-		msg.Data = strings.Join(keys, ",")
-		log.Printf("Current room (%s) members: %s", roomName, msg.Data)
-		h.messages <- generateMessage(msg, nil, roomName)
-	} else {
-		log.Println("no room members to update")
-		delete(h.rooms, roomName)
+func (h *Hub) joinRoom(client *Client, room *Room, asObserver bool) {
+	h.clientRoomChangeHandler(client, room)
+	room.lock.Lock()
+	defer room.lock.Unlock()
+	//joining as an observer only lasts until the client leaves, it never changes the user's stored role
+	if asObserver {
+		room.observers[client.name] = true
+	}
+	if err := h.announceRoles(room); err != nil {
+		log.Printf("could not announce roles of room %s: %s", room.name, err)
 	}
-
 }
 
-func (h *Hub) clientRoomChangeHandler(clientChangingRooms *Client, newRoom string) {
-	log.Printf("%s joining room: %s", clientChangingRooms.name, newRoom)
+// moves a client between rooms, only one room lock is held at a time
+func (h *Hub) clientRoomChangeHandler(clientChangingRooms *Client, newRoom *Room) {
+	log.Printf("%s joining room: %s", clientChangingRooms.name, newRoom.name)
 	//remove client from previous room
-	delete(h.rooms[clientChangingRooms.room].clients, clientChangingRooms.name)
-	//notify remaining room clients of leaving member
-	h.updateRoomMembers(clientChangingRooms.room)
+	if previousRoom, ok := h.rooms[clientChangingRooms.getRoom()]; ok {
+		previousRoom.lock.Lock()
+		delete(previousRoom.clients, clientChangingRooms.name)
+		delete(previousRoom.observers, clientChangingRooms.name)
+		previousRoom.abandonTransfers(clientChangingRooms)
+		//notify remaining room clients of leaving member
+		h.updateRoomMembers(previousRoom)
+		empty := previousRoom != newRoom && previousRoom.markIfEmpty()
+		previousRoom.lock.Unlock()
+		if empty && previousRoom.name != "server" && !previousRoom.persistent {
+			h.deleteWhenEmpty(previousRoom)
+		}
+	}
 	//add them to the new room
-	clientChangingRooms.room = newRoom
-	h.rooms[newRoom].clients[clientChangingRooms.name] = clientChangingRooms
+	newRoom.lock.Lock()
+	defer newRoom.lock.Unlock()
+	clientChangingRooms.setRoom(newRoom.name)
+	newRoom.clients[clientChangingRooms.name] = clientChangingRooms
+	newRoom.emptySince = time.Time{}
 	//notify current room clients of new member
 	h.updateRoomMembers(newRoom)
+	//catch the new member up on the room's comment threads
+	if len(newRoom.comments.requestsWithComments) > 0 {
+		if err := h.sendAllComments(newRoom, clientChangingRooms); err != nil {
+			log.Printf("could not send comments to %s: %s", clientChangingRooms.name, err)
+		}
+	}
+}
+
+// deletes the room on the hub goroutine once it has been left empty for emptyRoomLifetime
+func (h *Hub) deleteWhenEmpty(room *Room) {
+	time.AfterFunc(emptyRoomLifetime, func() {
+		h.emptyRooms <- room
+	})
+}
+
+// disconnects the clients of users whose account was removed or reset since the user list was last read
+func (h *Hub) watchUsers(users *UserStore) {
+	for range time.Tick(userReloadInterval) {
+		changedUsers, err := users.Reload()
+		if err != nil {
+			log.Printf("could not reload users: %s", err)
+			continue
+		}
+		for _, username := range changedUsers {
+			h.disconnectUser(username)
+		}
+	}
+}
+
+// closes every connection of the user, their readers then unregister them as usual
+func (h *Hub) disconnectUser(username string) {
+	h.roomsLock.RLock()
+	defer h.roomsLock.RUnlock()
+	for _, room := range h.rooms {
+		room.lock.Lock()
+		for _, client := range room.clients {
+			if client.username == username {
+				log.Printf("disconnecting %s, their account changed", client.name)
+				_ = client.conn.Close()
+			}
+		}
+		room.lock.Unlock()
+	}
+}
+
+// replies to the sender of a failed message, errors that aren't ClientErrors are not described to the client
+func (h *Hub) sendError(message *Message, err error) {
+	if message.sender == nil {
+		return
+	}
+	clientError, ok := err.(*ClientError)
+	if !ok {
+		clientError = newClientError(ErrorInternal, "the server could not handle %s", message.msg.MessageType)
+	}
+	clientError.MessageType = message.msg.MessageType
+	errorBytes, err := json.Marshal(clientError)
+	if err != nil {
+		log.Printf("could not marshal error for %s: %s", message.sender.name, err)
+		return
+	}
+	msg := NewBurpTCMessage()
+	msg.MessageType = "ERROR_MESSAGE"
+	msg.Data = string(errorBytes)
+	message.sender.trySend(generateMessage(msg, message.sender, message.roomName))
+}
+
+// adds the room to the hub and starts its goroutine
+func (h *Hub) addRoom(room *Room) {
+	h.roomsLock.Lock()
+	h.rooms[room.name] = room
+	h.roomsLock.Unlock()
+	go room.eventLoop(h)
+}
+
+func (h *Hub) deleteRoom(room *Room) {
+	//the room may already be gone if its last member left while it was being deleted
+	if h.rooms[room.name] != room {
+		return
+	}
+	if room.persistent && h.roomStore != nil {
+		if err := h.roomStore.DeleteRoom(room.name); err != nil {
+			log.Printf("could not delete persistent room %s: %s", room.name, err)
+		}
+	}
+	h.roomsLock.Lock()
+	delete(h.rooms, room.name)
+	h.roomsLock.Unlock()
+	room.stop()
+	if h.history != nil {
+		h.history.Remove(room.name)
+	}
+	if h.blobs != nil {
+		h.blobs.RemoveRoom(room.name)
+	}
+}
+
+// the store for bodies shared in the room, nil for the lobby which keeps no history for them to be referenced from
+func (h *Hub) roomBlobs(room *Room) *BlobStore {
+	if room.name == "server" {
+		return nil
+	}
+	return h.blobs.forRoom(room.name)
+}
+
+func (h *Hub) SetMessageRateLimit(messagesPerSecond int) {
+	h.messageRateLimit = messagesPerSecond
+}
+
+func (h *Hub) SetMaxMessageSize(bytes int64) {
+	h.maxMessageSize = bytes
+}
+
+func (h *Hub) SetCompressionThreshold(bytes int) {
+	h.compressionThreshold = bytes
+}
+
+func (h *Hub) SetRedactor(redactor *Redactor) {
+	h.redactor = redactor
 }
 
 func (h *Hub) SetShortenerService(shortenerService *ShortenedUrls) {
@@ -0,0 +1,330 @@
+package internal
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/valyala/fasthttp"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// a client with no connection whose messages can be read straight from its send channel
+func newTestClient(username string) *Client {
+	return &Client{
+		room:         "server",
+		name:         username + "#1",
+		username:     username,
+		mutedClients: []string{},
+		sendChannel:  make(chan *Message, 16),
+	}
+}
+
+func awaitClientError(t *testing.T, client *Client) *ClientError {
+	select {
+	case message := <-client.sendChannel:
+		if message.msg.MessageType != "ERROR_MESSAGE" {
+			t.Fatalf("got %s instead of an error", message.msg.MessageType)
+		}
+		clientError := &ClientError{}
+		if err := json.Unmarshal([]byte(message.msg.Data), clientError); err != nil {
+			t.Fatal(err)
+		}
+		return clientError
+	case <-time.After(5 * time.Second):
+		t.Fatal("no error was sent")
+	}
+	return nil
+}
+
+func TestServerErrorCodes(t *testing.T) {
+	h := NewHub("", nil, nil, nil)
+	client := newTestClient("errors")
+
+	//the reader refuses messages over the rate limit before they are routed
+	if !client.allowMessage(2) || !client.allowMessage(2) || client.allowMessage(2) {
+		t.Fatal("a third message within the same second was allowed")
+	}
+	h.route(&Message{msg: &BurpTCMessage{MessageType: "BURP_MESSAGE"}, sender: client, roomName: "server", err: newClientError(ErrorRateLimited, "too fast")})
+	if clientError := awaitClientError(t, client); clientError.Code != ErrorRateLimited {
+		t.Errorf("rate limited message got %+v", clientError)
+	}
+
+	h.route(&Message{msg: &BurpTCMessage{MessageType: "SHORTEN_LINK_MESSAGE"}, sender: client, roomName: "server"})
+	if clientError := awaitClientError(t, client); clientError.Code != ErrorShortenerDisabled {
+		t.Errorf("shortening without a shortener got %+v", clientError)
+	}
+
+	//failures that aren't the client's fault don't leak their details
+	h.handleMessage(&Message{msg: &BurpTCMessage{MessageType: "BURP_MESSAGE"}, sender: client, roomName: "server"}, func(*Message) error {
+		return errors.New("disk on fire")
+	})
+	if clientError := awaitClientError(t, client); clientError.Code != ErrorInternal || clientError.Reason == "disk on fire" {
+		t.Errorf("internal failure got %+v", clientError)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	h := NewHub("", nil, nil, nil)
+	client := newTestClient("panics")
+	h.handleMessage(&Message{msg: &BurpTCMessage{MessageType: "BURP_MESSAGE"}, sender: client, roomName: "server"}, func(*Message) error {
+		panic("handler bug")
+	})
+	if clientError := awaitClientError(t, client); clientError.Code != ErrorInternal {
+		t.Errorf("panicking handler got %+v", clientError)
+	}
+	//a panic while replying to a broken sender is recovered as well
+	h.handleMessage(&Message{msg: &BurpTCMessage{MessageType: "BURP_MESSAGE"}, roomName: "server"}, func(*Message) error {
+		panic("handler bug")
+	})
+	if recovered := h.RecoveredPanics(); recovered != 2 {
+		t.Fatalf("counted %d recovered panics instead of 2", recovered)
+	}
+
+	//the count is reported by /stats
+	hub = h
+	ctx := &fasthttp.RequestCtx{}
+	handleStats(ctx)
+	stats := &ServerStats{}
+	if err := json.Unmarshal(ctx.Response.Body(), stats); err != nil {
+		t.Fatal(err)
+	}
+	if stats.RecoveredPanics != 2 {
+		t.Fatalf("/stats reported %d recovered panics instead of 2", stats.RecoveredPanics)
+	}
+}
+
+func TestDeletedRoomRefusesMessages(t *testing.T) {
+	h := NewHub("", nil, nil, nil)
+	client := newTestClient("late")
+	room := newRoom("deleted", nil, false)
+	//queued before the room was deleted but never handled
+	for i := 0; i < 2; i++ {
+		if !room.enqueue(&Message{msg: &BurpTCMessage{MessageType: "BURP_MESSAGE"}, sender: client, roomName: room.name}) {
+			t.Fatal("a running room refused a message")
+		}
+	}
+	room.stop()
+	if room.enqueue(&Message{msg: &BurpTCMessage{MessageType: "BURP_MESSAGE"}, sender: client, roomName: room.name}) {
+		t.Fatal("a deleted room queued a message")
+	}
+	room.eventLoop(h)
+	for i := 0; i < 2; i++ {
+		if clientError := awaitClientError(t, client); clientError.Code != ErrorRoomNotFound {
+			t.Errorf("message queued for a deleted room got %+v", clientError)
+		}
+	}
+
+	//messages routed after the room is gone are refused the same way
+	h.route(&Message{msg: &BurpTCMessage{MessageType: "BURP_MESSAGE"}, sender: client, roomName: room.name})
+	if clientError := awaitClientError(t, client); clientError.Code != ErrorRoomNotFound {
+		t.Errorf("message routed to a deleted room got %+v", clientError)
+	}
+}
+
+func TestRoomStoreWritesLatestSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "rooms.db")
+	roomStore, err := NewRoomStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, deleted := newRoom("kept", nil, true), newRoom("deleted", nil, true)
+	for _, scope := range []string{"first", "second"} {
+		kept.scope = scope
+		if err := roomStore.SaveRoom(kept); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//saving only snapshots the room, later changes wait for the next save
+	kept.scope = "unsaved"
+	if err := roomStore.SaveRoom(deleted); err != nil {
+		t.Fatal(err)
+	}
+	if err := roomStore.DeleteRoom(deleted.name); err != nil {
+		t.Fatal(err)
+	}
+	if err := roomStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if roomStore, err = NewRoomStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer roomStore.Close()
+	rooms, err := roomStore.LoadRooms()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rooms) != 1 || rooms[0].name != "kept" || rooms[0].scope != "second" || !rooms[0].created.Equal(kept.created) {
+		t.Fatalf("loaded rooms %+v", rooms)
+	}
+}
+
+func TestServerHelloFollowsConfig(t *testing.T) {
+	h := NewHub("", nil, nil, nil)
+	advertised := func() map[string]bool {
+		serverHello := h.serverHello()
+		advertised := make(map[string]bool)
+		for _, advertisement := range append(serverHello.Features, serverHello.MessageTypes...) {
+			advertised[advertisement] = true
+		}
+		return advertised
+	}
+	hello := advertised()
+	for _, advertisement := range []string{"HELLO_MESSAGE", "BURP_MESSAGE", "CHUNK_MESSAGE", "chunkedTransfers"} {
+		if !hello[advertisement] {
+			t.Errorf("%s was not advertised", advertisement)
+		}
+	}
+	for _, advertisement := range []string{"blobs", "history", "persistentRooms", "shortener", "GET_BLOB_MESSAGE", "GET_HISTORY_MESSAGE", "SHORTEN_LINK_MESSAGE", "REVOKE_LINK_MESSAGE"} {
+		if hello[advertisement] {
+			t.Errorf("%s was advertised by a server without it", advertisement)
+		}
+	}
+	//types only the server sends aren't offered to clients
+	for _, serverOnly := range []string{"NEW_MEMBER_MESSAGE", "ROLES_MESSAGE", "COMMENTS_MESSAGE", "ALL_COMMENTS_MESSAGE", "HISTORY_MESSAGE", "BLOB_MESSAGE", "ERROR_MESSAGE", "GOOD_PASSWORD_MESSAGE"} {
+		if hello[serverOnly] {
+			t.Errorf("%s was advertised to clients", serverOnly)
+		}
+	}
+	h.SetShortenerService(&ShortenedUrls{})
+	if hello := advertised(); !hello["shortener"] || !hello["GET_LINKS_MESSAGE"] {
+		t.Error("the shortener was not advertised once enabled")
+	}
+	//message types that depend on a feature still have to be routed
+	for messageType := range messageTypeFeatures {
+		if !hubMessageTypes[messageType] && !roomMessageTypes[messageType] {
+			t.Errorf("%s is not in either routing table", messageType)
+		}
+	}
+}
+
+func TestStalledTransferExpires(t *testing.T) {
+	h := NewHub("", nil, nil, nil)
+	client := newTestClient("stalled")
+	room := newRoom("transfers", nil, false)
+	chunk := &TransferChunk{TransferId: "stalled", MessageType: "BURP_MESSAGE", Count: 2}
+	if _, complete, err := room.acceptChunk(client, chunk, &BurpRequestResponse{Request: BurpBytes("GET")}, nil); err != nil || complete != nil {
+		t.Fatalf("first chunk gave %v: %v", complete, err)
+	}
+	room.expireTransfers(h, time.Now())
+	if len(room.transfers) != 1 {
+		t.Fatal("a transfer was dropped before it timed out")
+	}
+	room.expireTransfers(h, time.Now().Add(chunkedTransferTimeout))
+	if len(room.transfers) != 0 {
+		t.Fatal("a stalled transfer was kept")
+	}
+	if clientError := awaitClientError(t, client); clientError.Code != ErrorTransferExpired {
+		t.Errorf("stalled transfer got %+v", clientError)
+	}
+	//its next chunk has nothing to continue
+	chunk.Index = 1
+	if _, _, err := room.acceptChunk(client, chunk, nil, nil); err == nil {
+		t.Fatal("a chunk continued an expired transfer")
+	}
+}
+
+func TestCommentKeyFollowsBlobs(t *testing.T) {
+	blobs, err := NewBlobStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHub("", nil, nil, blobs)
+	room := newRoom("comments", nil, false)
+	request := BurpBytes("GET /commented HTTP/1.1\r\n\r\n")
+	hash, err := h.roomBlobs(room).Put(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, inlineKey, err := h.commentedRequest(room, &BurpRequestResponse{Request: request})
+	if err != nil {
+		t.Fatal(err)
+	}
+	commented, hashKey, err := h.commentedRequest(room, &BurpRequestResponse{RequestHash: hash})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if inlineKey != hashKey || string(commented.Request) != string(request) {
+		t.Fatalf("a request sent by hash is commented under %s instead of %s", hashKey, inlineKey)
+	}
+	//another room can't refer to it
+	if _, _, err := h.commentedRequest(newRoom("other", nil, false), &BurpRequestResponse{RequestHash: hash}); err == nil {
+		t.Fatal("a request was loaded from another room's blobs")
+	}
+}
+
+func TestTransferLimits(t *testing.T) {
+	room := newRoom("limits", nil, false)
+	sender, other := newTestClient("sender"), newTestClient("other")
+	send := func(client *Client, transferId string, index int, body []byte) error {
+		chunk := &TransferChunk{TransferId: transferId, MessageType: "BURP_MESSAGE", Index: index, Count: 3}
+		_, _, err := room.acceptChunk(client, chunk, &BurpRequestResponse{Request: body}, nil)
+		return err
+	}
+	for i := 0; i < maxOpenTransfersPerSender; i++ {
+		if err := send(sender, fmt.Sprintf("open-%d", i), 0, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var clientError *ClientError
+	if err := send(sender, "one-too-many", 0, nil); !errors.As(err, &clientError) || clientError.Code != ErrorTransferLimit {
+		t.Fatalf("a transfer over the per-sender limit got %v", err)
+	}
+	//other members aren't held back by it
+	if err := send(other, "other", 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	//the room refuses chunks once its transfers hold too much between them
+	if err := send(sender, "open-0", 1, []byte("held")); err != nil {
+		t.Fatal(err)
+	}
+	room.transferBytes = maxRoomTransferBytes
+	if err := send(other, "other", 1, []byte("x")); !errors.As(err, &clientError) || clientError.Code != ErrorTransferLimit {
+		t.Fatalf("a chunk over the room limit got %v", err)
+	}
+	//the refused chunk can be sent again once the room frees up
+	room.transferBytes = len("held")
+	room.abandonTransfers(sender)
+	if room.transferBytes != 0 {
+		t.Fatalf("abandoned transfers still count %d bytes", room.transferBytes)
+	}
+	if err := send(other, "other", 1, []byte("x")); err != nil {
+		t.Fatal(err)
+	}
+	if err := send(other, "other", 2, []byte("y")); err != nil {
+		t.Fatal(err)
+	}
+	if room.transferBytes != 0 {
+		t.Fatalf("a finished transfer still counts %d bytes", room.transferBytes)
+	}
+}
+
+func TestHeldTransfersAreSmaller(t *testing.T) {
+	room := newRoom("held", nil, false)
+	sender := newTestClient("sender")
+	patterns, err := NewRedactor(&RedactionRules{Patterns: []string{"secret=(\\w+)"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers, err := NewRedactor(&defaultRedactionRules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, maxHeldTransferSize+1)
+	chunk := &TransferChunk{TransferId: "held", MessageType: "BURP_MESSAGE", Count: 2}
+	var clientError *ClientError
+	if _, _, err := room.acceptChunk(sender, chunk, &BurpRequestResponse{Response: body}, patterns); !errors.As(err, &clientError) || clientError.Code != ErrorMessageTooLarge {
+		t.Fatalf("a held transfer over its limit got %v", err)
+	}
+	if len(room.transfers) != 0 || room.transferBytes != 0 {
+		t.Fatal("a transfer over its limit was kept")
+	}
+	//rules that only look at heads let the same transfer through as it arrives
+	chunk.TransferId = "streamed"
+	if part, _, err := room.acceptChunk(sender, chunk, &BurpRequestResponse{Response: body}, headers); err != nil || part == nil {
+		t.Fatalf("a streamed transfer got %v: %v", part, err)
+	}
+}
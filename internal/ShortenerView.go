@@ -0,0 +1,178 @@
+package internal
+
+import (
+	"bytes"
+	"github.com/valyala/fasthttp"
+	"html/template"
+	"mime"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// the page a shortened link shows in a browser. Everything is inline so the page works without any other requests
+var shortenerViewTemplate = template.Must(template.New("shortenerView").Parse(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Shared request{{with .Service}} to {{.Host}}{{end}}</title>
+<style nonce="{{.Nonce}}">
+body { font-family: sans-serif; margin: 2em; color: #222; }
+pre { background: #f4f4f4; border: 1px solid #ddd; padding: 1em; overflow-x: auto; white-space: pre-wrap; word-break: break-all; }
+table { border-collapse: collapse; }
+td, th { text-align: left; padding: 0.2em 1em 0.2em 0; }
+.comment { border-left: 3px solid #e8702a; padding-left: 1em; margin-bottom: 1em; }
+.meta { color: #666; font-size: 0.9em; }
+</style>
+</head>
+<body>
+<h1>Shared request</h1>
+{{with .Service}}<table>
+<tr><th>Host</th><td>{{.Host}}</td></tr>
+<tr><th>Port</th><td>{{.Port}}</td></tr>
+<tr><th>Protocol</th><td>{{.Protocol}}</td></tr>
+</table>{{end}}
+<h2>Request</h2>
+<pre>{{.Request}}</pre>
+{{if .Curl}}<h2>Copy as curl <button id="copyCurl" type="button">Copy</button></h2>
+<pre id="curl">{{.Curl}}</pre>{{end}}
+<h2>Response</h2>
+{{if .Response}}<pre>{{.Response}}</pre>{{else}}<p class="meta">No response was shared.</p>{{end}}
+{{if .Comments}}<h2>Comments</h2>
+{{range .Comments}}<div class="comment"><p class="meta">{{.UserWhoCommented}} at {{.TimeOfComment}}</p><p>{{.Comment}}</p></div>
+{{end}}{{end}}
+{{if .Curl}}<script nonce="{{.Nonce}}">
+document.getElementById("copyCurl").addEventListener("click", function () {
+	navigator.clipboard.writeText(document.getElementById("curl").textContent);
+});
+</script>{{end}}
+</body>
+</html>
+`))
+
+type shortenerView struct {
+	Service  *BurpMetaData
+	Request  string
+	Response string
+	Comments []Comment
+	Curl     string
+	Nonce    string
+}
+
+// returns true when the client prefers HTML over JSON, ties go to JSON since that is what the extension expects
+func wantsHTML(ctx *fasthttp.RequestCtx) bool {
+	switch string(ctx.QueryArgs().Peek("format")) {
+	case "html":
+		return true
+	case "json":
+		return false
+	}
+	htmlQuality, jsonQuality := 0.0, 0.0
+	for _, accepted := range strings.Split(string(ctx.Request.Header.Peek("Accept")), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil {
+			continue
+		}
+		quality := 1.0
+		if q, ok := params["q"]; ok {
+			if quality, err = strconv.ParseFloat(q, 64); err != nil {
+				continue
+			}
+		}
+		switch mediaType {
+		case "text/html":
+			htmlQuality = quality
+		case "application/json":
+			jsonQuality = quality
+		case "*/*", "application/*":
+			if jsonQuality < quality {
+				jsonQuality = quality
+			}
+		}
+	}
+	return htmlQuality > jsonQuality
+}
+
+func writeShortenerView(ctx *fasthttp.RequestCtx, burpRequest *BurpRequestResponse) error {
+	nonce, err := generateRandomString(24)
+	if err != nil {
+		return err
+	}
+	view := &shortenerView{
+		Service:  burpRequest.HttpService,
+		Request:  strings.ToValidUTF8(string(burpRequest.Request), "�"),
+		Response: strings.ToValidUTF8(string(burpRequest.Response), "�"),
+		Comments: burpRequest.Comments,
+		Curl:     curlCommand(burpRequest),
+		Nonce:    nonce,
+	}
+	var page bytes.Buffer
+	if err := shortenerViewTemplate.Execute(&page, view); err != nil {
+		return err
+	}
+	ctx.Response.Header.Set("Content-Type", "text/html; charset=utf-8")
+	ctx.Response.Header.Set("Content-Security-Policy", "default-src 'none'; style-src 'nonce-"+nonce+"'; script-src 'nonce-"+nonce+"'")
+	//the link id is the only thing protecting the request, so don't hand it to other sites
+	ctx.Response.Header.Set("Referrer-Policy", "no-referrer")
+	ctx.Response.Header.Set("X-Content-Type-Options", "nosniff")
+	_, _ = ctx.Write(page.Bytes())
+	return nil
+}
+
+// quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// rebuilds the request as a curl command, or returns an empty string if it doesn't look like an HTTP request
+func curlCommand(burpRequest *BurpRequestResponse) string {
+	if burpRequest.HttpService == nil || len(burpRequest.Request) == 0 {
+		return ""
+	}
+	request := string(burpRequest.Request)
+	head, body := request, ""
+	if headEnd := strings.Index(request, "\r\n\r\n"); headEnd >= 0 {
+		head, body = request[:headEnd], request[headEnd+4:]
+	}
+	lines := strings.Split(head, "\r\n")
+	requestLine := strings.Fields(lines[0])
+	if len(requestLine) < 2 {
+		return ""
+	}
+	service := burpRequest.HttpService
+	host := service.Host
+	//IPv6 addresses need brackets in a url
+	if strings.Contains(host, ":") && !strings.HasPrefix(host, "[") {
+		host = "[" + host + "]"
+	}
+	hostWithPort := net.JoinHostPort(strings.Trim(host, "[]"), strconv.Itoa(service.Port))
+	authority := host
+	if !(service.Protocol == "https" && service.Port == 443) && !(service.Protocol == "http" && service.Port == 80) {
+		authority = hostWithPort
+	}
+	url := service.Protocol + "://" + authority + requestLine[1]
+
+	//one option per line to keep long requests readable
+	command := []string{"curl -X " + shellQuote(requestLine[0])}
+	for _, header := range lines[1:] {
+		nameAndValue := strings.SplitN(header, ":", 2)
+		name := strings.TrimSpace(nameAndValue[0])
+		//curl works these out itself from the url and body, unless the Host header names somewhere else
+		if strings.EqualFold(name, "Content-Length") || len(name) == 0 {
+			continue
+		}
+		if strings.EqualFold(name, "Host") && len(nameAndValue) == 2 {
+			value := strings.TrimSpace(nameAndValue[1])
+			if strings.EqualFold(value, service.Host) || strings.EqualFold(value, host) || strings.EqualFold(value, hostWithPort) {
+				continue
+			}
+		}
+		command = append(command, "-H "+shellQuote(header))
+	}
+	if len(body) > 0 {
+		command = append(command, "--data-binary "+shellQuote(body))
+	}
+	command = append(command, shellQuote(url))
+	return strings.Join(command, " \\\n  ")
+}
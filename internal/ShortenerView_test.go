@@ -0,0 +1,38 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCurlCommand(t *testing.T) {
+	for _, test := range []struct {
+		service  *BurpMetaData
+		host     string
+		expected []string
+		missing  []string
+	}{
+		{&BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"}, "example.com", []string{"'https://example.com/path'"}, []string{"Host:"}},
+		{&BurpMetaData{Host: "example.com", Port: 8443, Protocol: "https"}, "example.com:8443", []string{"'https://example.com:8443/path'"}, []string{"Host:"}},
+		//requests sent to an address with another Host header need it kept
+		{&BurpMetaData{Host: "10.0.0.1", Port: 80, Protocol: "http"}, "internal.example", []string{"-H 'Host: internal.example'", "'http://10.0.0.1/path'"}, nil},
+		{&BurpMetaData{Host: "::1", Port: 443, Protocol: "https"}, "[::1]", []string{"'https://[::1]/path'"}, []string{"Host:"}},
+		{&BurpMetaData{Host: "::1", Port: 8080, Protocol: "http"}, "[::1]:8080", []string{"'http://[::1]:8080/path'"}, []string{"Host:"}},
+	} {
+		request := &BurpRequestResponse{
+			Request:     BurpBytes("GET /path HTTP/1.1\r\nHost: " + test.host + "\r\nAccept: */*\r\n\r\n"),
+			HttpService: test.service,
+		}
+		command := curlCommand(request)
+		for _, expected := range test.expected {
+			if !strings.Contains(command, expected) {
+				t.Errorf("curl command for %s is missing %s:\n%s", test.host, expected, command)
+			}
+		}
+		for _, missing := range test.missing {
+			if strings.Contains(command, missing) {
+				t.Errorf("curl command for %s has %s:\n%s", test.host, missing, command)
+			}
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"strings"
+)
+
+// defaults used when ServerConfig leaves the TLS versions unset
+const (
+	DefaultTLSMinVersion = tls.VersionTLS12
+	DefaultTLSMaxVersion = tls.VersionTLS13
+)
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// ParseTLSVersion turns a version such as "1.2" into its tls.VersionTLS constant
+func ParseTLSVersion(version string) (uint16, error) {
+	if tlsVersion, ok := tlsVersions[strings.TrimPrefix(strings.TrimSpace(version), "TLS")]; ok {
+		return tlsVersion, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q, use one of 1.0, 1.1, 1.2 or 1.3", version)
+}
+
+// ParseCipherSuites turns a comma separated list of cipher suite names, as listed by crypto/tls, into their ids. Only
+// suites for TLS 1.2 and below can be picked since Go always uses its own choice of TLS 1.3 suites
+func ParseCipherSuites(names string) ([]uint16, error) {
+	suites := make(map[string]*tls.CipherSuite)
+	for _, suite := range tls.CipherSuites() {
+		suites[suite.Name] = suite
+	}
+	insecureSuites := make(map[string]bool)
+	for _, suite := range tls.InsecureCipherSuites() {
+		insecureSuites[suite.Name] = true
+	}
+	var ids []uint16
+	for _, name := range strings.Split(names, ",") {
+		name = strings.TrimSpace(name)
+		if len(name) == 0 {
+			continue
+		}
+		suite, ok := suites[name]
+		switch {
+		case insecureSuites[name]:
+			return nil, fmt.Errorf("cipher suite %s is insecure", name)
+		case !ok:
+			return nil, fmt.Errorf("unknown cipher suite %s", name)
+		case len(suite.SupportedVersions) == 1 && suite.SupportedVersions[0] == tls.VersionTLS13:
+			return nil, fmt.Errorf("cipher suite %s is for TLS 1.3, which can't be configured", name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, nil
+}
+
+// CertFingerprint returns the SHA-256 fingerprint of the certificate in the colon separated hex most tools show
+func CertFingerprint(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.Raw)
+	hexBytes := make([]string, len(sum))
+	for i, b := range sum {
+		hexBytes[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(hexBytes, ":")
+}
@@ -3,66 +3,192 @@ package internal
 import (
 	"bytes"
 	"crypto/tls"
-	"crypto/x509"
+	"encoding/json"
 	"fmt"
 	"github.com/fasthttp/websocket"
 	"github.com/valyala/fasthttp"
-	"io/ioutil"
 	"log"
 	"net"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 var upgrader = websocket.FastHTTPUpgrader{
-	ReadBufferSize:  1024,
-	WriteBufferSize: 1024,
+	ReadBufferSize:    4096,
+	WriteBufferSize:   4096,
+	Subprotocols:      []string{WireProtocolV2},
+	EnableCompression: true,
 }
 
-func StartServer(serverPassword *string, host *string, enableUrlShortener *bool, shortenerPort *string, port *string) *Hub {
-	hub = NewHub(*serverPassword)
+type ServerConfig struct {
+	ServerPassword     string
+	Host               string
+	Port               string
+	EnableUrlShortener bool
+	//the shortener is served on the main port under /shortener, and also on this port when set
+	ShortenerPort string
+	//how long shortened links last unless their creator picks a ttl, 0 to keep them until they are viewed out
+	ShortenerTTL time.Duration
+	//length of the random ids given to shortened links
+	ShortenerIdLength int
+	//replaces the saved shortener API key when set, otherwise the saved key is used or a new one generated
+	ShortenerApiKey  string
+	DataDir          string
+	MessageRateLimit int
+	//messages smaller than this many bytes are sent uncompressed to clients that negotiated compression
+	CompressionThreshold int
+	//largest websocket message accepted from a client in bytes, 0 for no limit
+	MaxMessageSize int64
+	//JSON file with the default RedactionRules, the built in rules are used when empty
+	RedactionRulesFile string
+	//refuse clients that don't connect with a certificate issued to them by the server CA
+	RequireClientCerts bool
+	//server certificate, optionally followed by the rest of its chain, and its key. A self-signed one is generated
+	//when CertFile doesn't exist
+	CertFile string
+	KeyFile  string
+	//CA that client certificates must be issued by, CertFile when empty
+	ClientCAFile string
+	//key type of a generated server certificate, KeyTypeRSA when empty
+	KeyType string
+	//tls.VersionTLS constants, DefaultTLSMinVersion and DefaultTLSMaxVersion when 0
+	TLSMinVersion uint16
+	TLSMaxVersion uint16
+	//TLS 1.2 cipher suites to allow, Go's defaults when empty
+	CipherSuites []uint16
+}
 
-	GenCrt(*host)
-	if *enableUrlShortener {
-		shortendURLs := NewShortenedUrls(*shortenerPort, *host)
-		hub.SetShortenerService(shortendURLs)
+func StartServer(config *ServerConfig) *Hub {
+	history, err := NewHistoryStore(filepath.Join(config.DataDir, "history"))
+	if err != nil {
+		log.Fatalf("could not open room history: %s", err)
+	}
+	roomStore, err := NewRoomStore(filepath.Join(config.DataDir, "rooms.db"))
+	if err != nil {
+		log.Fatalf("could not open room database: %s", err)
+	}
+	blobs, err := NewBlobStore(filepath.Join(config.DataDir, "blobs"))
+	if err != nil {
+		log.Fatalf("could not open blob store: %s", err)
 	}
+	hub = NewHub(config.ServerPassword, history, roomStore, blobs)
+	hub.SetMessageRateLimit(config.MessageRateLimit)
+	hub.SetCompressionThreshold(config.CompressionThreshold)
+	hub.SetMaxMessageSize(config.MaxMessageSize)
+	redactor, err := LoadRedactionRules(config.RedactionRulesFile)
+	if err != nil {
+		log.Fatalf("could not load redaction rules: %s", err)
+	}
+	hub.SetRedactor(redactor)
 
-	if _, err := os.Stat("./burpServer.pem"); err == nil {
-		fmt.Println("file burpServer.pem found switching to https")
-		caCert, err := ioutil.ReadFile("./burpServer.pem")
+	users, err := LoadUserStore(filepath.Join(config.DataDir, UsersFileName))
+	if err != nil {
+		log.Fatalf("could not load users: %s", err)
+	}
+	if users.HasUsers() {
+		log.Println("user accounts found, authenticating clients per user")
+	}
+	go hub.watchUsers(users)
+	clientCerts, err := LoadClientCertStore(filepath.Join(config.DataDir, ClientCertsFileName))
+	if err != nil {
+		log.Fatalf("could not load client certificates: %s", err)
+	}
+
+	if len(config.CertFile) == 0 {
+		config.CertFile, config.KeyFile = ServerCertFile, ServerKeyFile
+	}
+	if len(config.ClientCAFile) == 0 {
+		config.ClientCAFile = config.CertFile
+	}
+	if len(config.KeyType) == 0 {
+		config.KeyType = KeyTypeRSA
+	}
+	GenCrt(config.Host, config.CertFile, config.KeyFile, config.KeyType)
+	if config.TLSMinVersion == 0 {
+		config.TLSMinVersion = DefaultTLSMinVersion
+	}
+	if config.TLSMaxVersion == 0 {
+		config.TLSMaxVersion = DefaultTLSMaxVersion
+	}
+	if config.TLSMinVersion > config.TLSMaxVersion {
+		log.Fatalf("the minimum TLS version is above the maximum")
+	}
+	var shortener *ShortenedUrls
+	if config.EnableUrlShortener {
+		links, err := NewLinkStore(filepath.Join(config.DataDir, "links.db"))
 		if err != nil {
-			log.Fatal(err)
+			log.Fatalf("could not open shortened url database: %s", err)
+		}
+		if shortener, err = NewShortenedUrls(config, links, redactor); err != nil {
+			log.Fatalf("could not start shortener service: %s", err)
 		}
-		crt, err := tls.LoadX509KeyPair("./burpServer.pem", "./burpServer.key")
+		hub.SetShortenerService(shortener)
+	}
+
+	if _, err := os.Stat(config.CertFile); err == nil {
+		fmt.Println("file", config.CertFile, "found switching to https")
+		certs, err := newCertReloader(config.CertFile, config.KeyFile, config.ClientCAFile)
 		if err != nil {
 			log.Fatal(err)
 		}
-		caCertPool := x509.NewCertPool()
-		caCertPool.AppendCertsFromPEM(caCert)
-		// Create the TLS Config with the CA pool and enable Client certificate validation
+		go certs.watchExpiry()
+		// Create the TLS Config with the CA pool and enable Client certificate validation. The certificate and CA
+		// pool come from certs on every handshake so they can be renewed while the server runs
 		tlsConfig := &tls.Config{
-			ClientCAs:    caCertPool,
-			ClientAuth:   tls.VerifyClientCertIfGiven,
-			MaxVersion:   tls.VersionTLS12,
-			Certificates: []tls.Certificate{crt},
+			ClientAuth:       tls.VerifyClientCertIfGiven,
+			MinVersion:       config.TLSMinVersion,
+			MaxVersion:       config.TLSMaxVersion,
+			CipherSuites:     config.CipherSuites,
+			GetCertificate:   certs.getCertificate,
+			VerifyConnection: clientCerts.verifyConnection(config.RequireClientCerts),
+		}
+		if config.RequireClientCerts {
+			log.Println("clients must connect with their own certificate")
+			tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
 		}
+		tlsConfig.GetConfigForClient = certs.getConfigForClient(tlsConfig)
 
-		ln, err := net.Listen("tcp", ":"+*port)
+		if shortener != nil && len(config.ShortenerPort) > 0 {
+			shortenerLn, err := net.Listen("tcp", ":"+config.ShortenerPort)
+			if err != nil {
+				log.Fatalf("could not start shortener service: %s", err)
+			}
+			//served with the same certificate as the main listener so links never travel in cleartext, but without asking
+			//for client certificates so links can be opened by anyone they're given to
+			shortenerTLSConfig := tlsConfig.Clone()
+			shortenerTLSConfig.ClientAuth = tls.NoClientCert
+			shortenerTLSConfig.GetConfigForClient = nil
+			go func() {
+				if err := fasthttp.Serve(tls.NewListener(shortenerLn, shortenerTLSConfig), shortener.HandleShortUrl); err != nil {
+					log.Printf("shortener service stopped: %s", err)
+				}
+			}()
+		}
+
+		ln, err := net.Listen("tcp", ":"+config.Port)
 		if err != nil {
 			log.Fatal(err)
 		}
-		log.Fatal(fasthttp.Serve(tls.NewListener(ln, tlsConfig), func(ctx *fasthttp.RequestCtx) {
+		log.Fatal(fasthttp.Serve(countingListener{tls.NewListener(ln, tlsConfig)}, func(ctx *fasthttp.RequestCtx) {
 			switch string(ctx.Path()) {
 			case "/":
-				if authHeader := ctx.Request.Header.Peek("Auth"); bytes.Equal(authHeader, []byte(*serverPassword)) {
-					username := string(ctx.Request.Header.Peek("Username"))
-
+				if username, ok := authenticateRequest(ctx, users, config); ok {
+					wireConn, _ := ctx.Conn().(*countingConn)
+					//only accounts and certificates prove who a client is, the shared password doesn't
+					verified := users.HasUsers() || len(clientCertUsername(ctx)) > 0
 					if err := upgrader.Upgrade(ctx, func(conn *websocket.Conn) {
 						log.Println("Opening connection")
-						client := hub.Register(conn, username)
+						client := hub.Register(conn, wireConn, username, verified)
 						log.Printf("client connection: %v", client)
-						go client.Writer()
+						writerDone := make(chan struct{})
+						go func() {
+							client.Writer()
+							close(writerDone)
+						}()
 						client.Reader()
+						//fasthttp reuses the connection once this returns, so wait for the writer to stop using it
+						<-writerDone
 
 					}); err != nil {
 						log.Println("Socket upgrade error:", err)
@@ -72,17 +198,73 @@ func StartServer(serverPassword *string, host *string, enableUrlShortener *bool,
 					ctx.Response.SetStatusCode(fasthttp.StatusUnauthorized)
 					ctx.SetBody([]byte("401 - Bad Auth!"))
 				}
+			case "/stats":
+				if _, ok := authenticateRequest(ctx, users, config); ok {
+					handleStats(ctx)
+				} else {
+					ctx.Response.SetStatusCode(fasthttp.StatusUnauthorized)
+					ctx.SetBody([]byte("401 - Bad Auth!"))
+				}
+			case ShortenerPath, ShortenerLinksPath:
+				if shortener != nil {
+					shortener.HandleShortUrl(ctx)
+				} else {
+					ctx.Error("Unsupported path", fasthttp.StatusNotFound)
+				}
 			default:
 				ctx.Error("Unsupported path", fasthttp.StatusNotFound)
 			}
 		}))
 
 	} else {
-		log.Printf("Server running at ws://%s:%s", *host, *port)
-		httpErr := fasthttp.ListenAndServe(":"+*port, nil)
+		log.Printf("Server running at ws://%s:%s", config.Host, config.Port)
+		httpErr := fasthttp.ListenAndServe(":"+config.Port, nil)
 		if httpErr != nil {
 			log.Fatal("ListenAndServe: ", err)
 		}
 	}
 	return hub
 }
+
+// returns who the client is. A certificate issued to a user is enough on its own, otherwise the client has to log in
+func authenticateRequest(ctx *fasthttp.RequestCtx, users *UserStore, config *ServerConfig) (string, bool) {
+	username := string(ctx.Request.Header.Peek("Username"))
+	if certUsername := clientCertUsername(ctx); len(certUsername) > 0 {
+		//a client can't use its certificate to act as someone else
+		if len(username) > 0 && username != certUsername {
+			log.Printf("client with the certificate of %s claimed to be %s", certUsername, username)
+			return "", false
+		}
+		return certUsername, true
+	}
+	if config.RequireClientCerts {
+		return "", false
+	}
+	return username, authenticateClient(users, config.ServerPassword, username, ctx.Request.Header.Peek("Auth"))
+}
+
+// when user accounts exist every client must log in as one, otherwise fall back to the shared server password
+func authenticateClient(users *UserStore, serverPassword string, username string, authHeader []byte) bool {
+	if users.HasUsers() {
+		return users.Authenticate(username, string(authHeader))
+	}
+	return bytes.Equal(authHeader, []byte(serverPassword))
+}
+
+type ServerStats struct {
+	RecoveredPanics uint64                `json:"recoveredPanics"`
+	Rooms           map[string]*RoomStats `json:"rooms"`
+}
+
+func handleStats(ctx *fasthttp.RequestCtx) {
+	statsJson, err := json.Marshal(&ServerStats{
+		RecoveredPanics: hub.RecoveredPanics(),
+		Rooms:           hub.RoomStats(),
+	})
+	if err != nil {
+		ctx.Error(err.Error(), fasthttp.StatusInternalServerError)
+		return
+	}
+	ctx.Response.Header.Add("Content-Type", "application/json")
+	_, _ = ctx.Write(statsJson)
+}
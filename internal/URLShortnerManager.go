@@ -1,26 +1,108 @@
 package internal
 
 import (
+	"crypto/subtle"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/valyala/fasthttp"
+	"io/ioutil"
 	"log"
-	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
-const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+const (
+	ShortenerKeyFileName = "shortener.key"
+	//the admin key lists, inspects and revokes every link, so unlike the API key it is never given to clients
+	ShortenerAdminKeyFileName = "shortener-admin.key"
+	ShortenerPath             = "/shortener"
+	ShortenerLinksPath        = ShortenerPath + "/links"
+	//how often expired links are deleted
+	linkReapInterval      = time.Minute
+	MinShortenerIdLength  = 8
+	MinShortenerKeyLength = 16
+	shortenerKeyLength    = 32
+	//a new id is picked if one is already taken, this many times in a row means something is wrong
+	linkIdAttempts = 5
+)
+
+// picks the id of a new link, tests replace it to force collisions
+var generateLinkId = generateRandomString
 
 type ShortenedUrls struct {
-	urls       map[string]BurpRequestResponse
-	seededRand *rand.Rand
-	apiKey     string
-	port       string
-	host       string
+	links      *LinkStore
+	defaultTTL time.Duration
+	idLength   int
+	//redaction rules for links that don't bring their own
+	redactor *Redactor
+	//where links are served from, either the /shortener route of the main listener or the opt-in shortener port
+	baseURL string
+	//the keys live in files so they can be rotated from the command line while the server runs
+	apiKey   *apiKeyFile
+	adminKey *apiKeyFile
+}
+
+// a key file and the key last read from it
+type apiKeyFile struct {
+	path     string
+	lock     sync.Mutex
+	key      string
+	modified time.Time
+}
+
+// options chosen when a link is created, see the README for the query parameters they come from
+type linkOptions struct {
+	ttl              time.Duration
+	maxViews         int
+	burnAfterReading bool
+	//only known for links shared by a connected client, anyone with the API key could claim to be someone else
+	creator     string
+	room        string
+	roomCreated time.Time
+	redactor    *Redactor
+	//where bodies sent by hash are loaded from, the blobs of the room the link is shared from
+	blobs *BlobStore
+}
+
+func (shortenedUrls *ShortenedUrls) parseLinkOptions(args *fasthttp.Args) (*linkOptions, error) {
+	options := &linkOptions{ttl: shortenedUrls.defaultTTL, redactor: shortenedUrls.redactor}
+	var err error
+	if ttl := args.Peek("ttl"); ttl != nil {
+		if options.ttl, err = time.ParseDuration(string(ttl)); err != nil || options.ttl < 0 {
+			return nil, errors.New("improper ttl")
+		}
+	}
+	if maxViews := args.Peek("maxViews"); maxViews != nil {
+		if options.maxViews, err = strconv.Atoi(string(maxViews)); err != nil || options.maxViews < 0 {
+			return nil, errors.New("improper maxViews")
+		}
+	}
+	if burn := args.Peek("burn"); burn != nil {
+		if options.burnAfterReading, err = strconv.ParseBool(string(burn)); err != nil {
+			return nil, errors.New("improper burn")
+		}
+	}
+	if redaction := args.Peek("redaction"); redaction != nil {
+		if options.redactor, err = parseRedactionRules(string(redaction)); err != nil {
+			return nil, errors.New("improper redaction")
+		}
+	}
+	return options, nil
 }
 
 func (shortenedUrls *ShortenedUrls) HandleShortUrl(ctx *fasthttp.RequestCtx) {
+	if string(ctx.Path()) == ShortenerLinksPath {
+		shortenedUrls.handleLinks(ctx)
+		return
+	}
 	switch string(ctx.Method()) {
 	case http.MethodGet:
 		shortId := string(ctx.QueryArgs().Peek("id"))
@@ -31,7 +113,17 @@ func (shortenedUrls *ShortenedUrls) HandleShortUrl(ctx *fasthttp.RequestCtx) {
 			return
 		}
 
-		if burpRequest := shortenedUrls.getShortenedURL(shortId); burpRequest != nil {
+		burpRequest, err := shortenedUrls.getShortenedURL(shortId)
+		if err != nil {
+			log.Printf("could not load shortened url %s: %s", shortId, err)
+			ctx.Error("Could not load request", http.StatusInternalServerError)
+			return
+		}
+		if burpRequest != nil && wantsHTML(ctx) {
+			if err := writeShortenerView(ctx, burpRequest); err != nil {
+				ctx.Error(err.Error(), http.StatusInternalServerError)
+			}
+		} else if burpRequest != nil {
 			burpRequestJson, err := json.Marshal(burpRequest)
 			if err != nil {
 				ctx.Error(err.Error(), http.StatusInternalServerError)
@@ -54,16 +146,32 @@ func (shortenedUrls *ShortenedUrls) HandleShortUrl(ctx *fasthttp.RequestCtx) {
 			ctx.SetBody([]byte("Improper key"))
 			return
 		}
-		log.Printf("User supplied key: %s\n", key)
-		if string(key) == shortenedUrls.apiKey {
+		if shortenedUrls.checkApiKey(key) {
 			var burpRequest = BurpRequestResponse{}
 			if err := json.Unmarshal(ctx.PostBody(), &burpRequest); err != nil {
 				ctx.Response.SetStatusCode(http.StatusBadRequest)
 				ctx.SetBody([]byte("Improper JSON"))
 				return
 			}
-			newId := shortenedUrls.addNewShortenURL(burpRequest)
-			accessURL := "https://" + shortenedUrls.host + ":" + shortenedUrls.port + "/shortener?id=" + newId
+			options, err := shortenedUrls.parseLinkOptions(ctx.QueryArgs())
+			if err != nil {
+				ctx.Response.SetStatusCode(http.StatusBadRequest)
+				ctx.SetBody([]byte(err.Error()))
+				return
+			}
+			//hashes name bodies in a room's blobs, which a request from outside any room has no access to
+			if (len(burpRequest.Request) == 0 && burpRequest.RequestHash != "") || (len(burpRequest.Response) == 0 && burpRequest.ResponseHash != "") {
+				ctx.Response.SetStatusCode(http.StatusBadRequest)
+				ctx.SetBody([]byte("Bodies must be sent inline, hashes only refer to blobs shared in a room"))
+				return
+			}
+			newId, err := shortenedUrls.addNewShortenURL(burpRequest, options)
+			if err != nil {
+				log.Printf("could not save shortened url: %s", err)
+				ctx.Error("Could not save request", http.StatusInternalServerError)
+				return
+			}
+			accessURL := shortenedUrls.linkURL(newId)
 			log.Println("POST: " + accessURL)
 			base64Text := make([]byte, base64.StdEncoding.EncodedLen(len(accessURL)))
 			base64.StdEncoding.Encode(base64Text, []byte(accessURL))
@@ -79,51 +187,185 @@ func (shortenedUrls *ShortenedUrls) HandleShortUrl(ctx *fasthttp.RequestCtx) {
 	}
 }
 
-func NewShortenedUrls(port string, host string) *ShortenedUrls {
+func NewShortenedUrls(config *ServerConfig, links *LinkStore, redactor *Redactor) (*ShortenedUrls, error) {
+	if config.ShortenerIdLength < MinShortenerIdLength {
+		return nil, fmt.Errorf("shortened url ids must be at least %d characters", MinShortenerIdLength)
+	}
+	//-host can list every name on the certificate, links use the first
+	host := strings.Split(config.Host, ",")[0]
 	manager := &ShortenedUrls{
-		make(map[string]BurpRequestResponse),
-		rand.New(
-			rand.NewSource(time.Now().UnixNano())),
-		"",
-		port,
-		host,
+		links:      links,
+		defaultTTL: config.ShortenerTTL,
+		idLength:   config.ShortenerIdLength,
+		redactor:   redactor,
+		baseURL:    "https://" + net.JoinHostPort(host, config.Port) + ShortenerPath,
+		apiKey:     &apiKeyFile{path: filepath.Join(config.DataDir, ShortenerKeyFileName)},
+		adminKey:   &apiKeyFile{path: filepath.Join(config.DataDir, ShortenerAdminKeyFileName)},
 	}
-	manager.apiKey = manager.genString()
-
-	go func() {
-		if err := fasthttp.ListenAndServe(":"+port, manager.HandleShortUrl); err != nil {
-			log.Printf("could not start shortener service: %s\n", err)
+	if len(config.ShortenerPort) > 0 {
+		manager.baseURL = "https://" + net.JoinHostPort(host, config.ShortenerPort) + ShortenerPath
+	}
+	//a key given on the command line replaces the saved one, otherwise the saved key is reused so shared links keep working
+	if len(config.ShortenerApiKey) > 0 {
+		if err := SaveShortenerApiKey(manager.apiKey.path, config.ShortenerApiKey); err != nil {
+			return nil, err
+		}
+	}
+	for _, keyFile := range []*apiKeyFile{manager.apiKey, manager.adminKey} {
+		if _, err := os.Stat(keyFile.path); os.IsNotExist(err) {
+			if _, err := RotateShortenerApiKey(keyFile.path); err != nil {
+				return nil, err
+			}
 		}
-	}()
+		if _, err := keyFile.load(); err != nil {
+			return nil, err
+		}
+	}
+
+	go manager.reapExpiredLinks()
 
-	return manager
+	return manager, nil
 }
 
-func (shortenedUrls *ShortenedUrls) genString() string {
-	b := make([]byte, 20)
-	for i := range b {
-		b[i] = charset[shortenedUrls.seededRand.Intn(len(charset))]
+func (shortenedUrls *ShortenedUrls) reapExpiredLinks() {
+	for range time.Tick(linkReapInterval) {
+		if reaped, err := shortenedUrls.links.ReapExpired(time.Now()); err != nil {
+			log.Printf("could not delete expired shortened urls: %s", err)
+		} else if reaped > 0 {
+			log.Printf("deleted %d expired shortened urls", reaped)
+		}
 	}
-	return string(b)
 }
 
-func (shortenedUrls *ShortenedUrls) addNewShortenURL(response BurpRequestResponse) string {
-	id := shortenedUrls.genString()
-	shortenedUrls.urls[id] = response
-	return id
+// links keep their bodies inline rather than in a room's blobs, so they outlive the room and their bodies go with them
+func (shortenedUrls *ShortenedUrls) addNewShortenURL(response BurpRequestResponse, options *linkOptions) (string, error) {
+	inline, err := options.blobs.loadBodies(&response)
+	if err != nil {
+		return "", err
+	}
+	response = *inline
+	if options.redactor.active() {
+		redacted, err := options.redactor.redactRequest(nil, &response)
+		if err != nil {
+			return "", err
+		}
+		response = *redacted
+	}
+	response.RequestHash, response.ResponseHash = "", ""
+	link := &ShortenedLink{
+		Request:          &response,
+		Created:          time.Now(),
+		MaxViews:         options.maxViews,
+		BurnAfterReading: options.burnAfterReading,
+		Creator:          options.creator,
+		Room:             options.room,
+		RoomCreated:      options.roomCreated,
+	}
+	if options.ttl > 0 {
+		link.Expires = link.Created.Add(options.ttl)
+	}
+	for attempt := 0; attempt < linkIdAttempts; attempt++ {
+		if link.Id, err = generateLinkId(shortenedUrls.idLength); err != nil {
+			return "", err
+		}
+		if err = shortenedUrls.links.CreateLink(link); err != errLinkExists {
+			return link.Id, err
+		}
+		log.Printf("shortened url id %s is already taken, picking another", link.Id)
+	}
+	return "", errors.New("could not find an unused shortened url id")
 }
 
-func (shortenedUrls *ShortenedUrls) getShortenedURL(id string) *BurpRequestResponse {
-	if burpRequest, ok := shortenedUrls.urls[id]; ok {
-		return &burpRequest
+func (shortenedUrls *ShortenedUrls) linkURL(id string) string {
+	return shortenedUrls.baseURL + "?id=" + id
+}
+
+// returns nil if the link doesn't exist, has expired or has been viewed as many times as it allows
+func (shortenedUrls *ShortenedUrls) getShortenedURL(id string) (*BurpRequestResponse, error) {
+	link, err := shortenedUrls.links.ViewLink(id)
+	if err != nil || link == nil {
+		return nil, err
+	}
+	//links carry their bodies inline, hashes would only point into a room's blobs
+	request := *link.Request
+	request.RequestHash, request.ResponseHash = "", ""
+	return &request, nil
+}
+
+func validateShortenerApiKey(key string) error {
+	if len(key) < MinShortenerKeyLength {
+		return fmt.Errorf("shortener API keys must be at least %d characters", MinShortenerKeyLength)
+	}
+	if strings.TrimSpace(key) != key {
+		return errors.New("shortener API keys cannot start or end with whitespace")
 	}
 	return nil
 }
 
-func (shortenedUrls *ShortenedUrls) setUrlShortenerApiKey(key string) {
-	shortenedUrls.apiKey = key
+// SaveShortenerApiKey replaces the shortener API key or admin key kept at path, a running server picks it up the next time the key is used
+func SaveShortenerApiKey(path string, key string) error {
+	if err := validateShortenerApiKey(key); err != nil {
+		return err
+	}
+	//write to a temporary file first so the server never reads a half written key
+	if err := ioutil.WriteFile(path+".tmp", []byte(key), 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// RotateShortenerApiKey replaces the key kept at path with a random one and returns it
+func RotateShortenerApiKey(path string) (string, error) {
+	key, err := generateRandomString(shortenerKeyLength)
+	if err != nil {
+		return "", err
+	}
+	return key, SaveShortenerApiKey(path, key)
+}
+
+// returns the current API key, given to clients so they can create links
+func (shortenedUrls *ShortenedUrls) getUrlShortenerApiKey() (string, error) {
+	return shortenedUrls.apiKey.load()
+}
+
+func (shortenedUrls *ShortenedUrls) checkApiKey(key []byte) bool {
+	return shortenedUrls.apiKey.check(key)
+}
+
+func (shortenedUrls *ShortenedUrls) checkAdminKey(key []byte) bool {
+	return shortenedUrls.adminKey.check(key)
 }
 
-func (shortenedUrls *ShortenedUrls) getUrlShortenerApiKey() string {
-	return shortenedUrls.apiKey
+// returns the key, reloading it if it was rotated since it was last read
+func (k *apiKeyFile) load() (string, error) {
+	k.lock.Lock()
+	defer k.lock.Unlock()
+	keyInfo, err := os.Stat(k.path)
+	if err != nil {
+		return "", err
+	}
+	if !keyInfo.ModTime().Equal(k.modified) {
+		keyBytes, err := ioutil.ReadFile(k.path)
+		if err != nil {
+			return "", err
+		}
+		if err := validateShortenerApiKey(string(keyBytes)); err != nil {
+			return "", err
+		}
+		if len(k.key) > 0 {
+			log.Printf("%s was rotated", filepath.Base(k.path))
+		}
+		k.key = string(keyBytes)
+		k.modified = keyInfo.ModTime()
+	}
+	return k.key, nil
+}
+
+func (k *apiKeyFile) check(key []byte) bool {
+	apiKey, err := k.load()
+	if err != nil {
+		log.Printf("could not load %s: %s", filepath.Base(k.path), err)
+		return false
+	}
+	return subtle.ConstantTimeCompare(key, []byte(apiKey)) == 1
 }
@@ -0,0 +1,91 @@
+package internal
+
+import (
+	"github.com/valyala/fasthttp"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLinkIdCollisionsPickAnotherId(t *testing.T) {
+	links, err := NewLinkStore(filepath.Join(t.TempDir(), "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer links.Close()
+	shortenedUrls := &ShortenedUrls{links: links, idLength: MinShortenerIdLength}
+	if err := links.CreateLink(&ShortenedLink{Id: "taken", Request: &BurpRequestResponse{Request: BurpBytes("GET /first")}}); err != nil {
+		t.Fatal(err)
+	}
+
+	ids := []string{"taken", "taken", "free"}
+	defer func() { generateLinkId = generateRandomString }()
+	generateLinkId = func(length int) (string, error) {
+		id := ids[0]
+		ids = ids[1:]
+		return id, nil
+	}
+	id, err := shortenedUrls.addNewShortenURL(BurpRequestResponse{Request: BurpBytes("GET /second")}, &linkOptions{})
+	if err != nil || id != "free" {
+		t.Fatalf("got id %q: %v", id, err)
+	}
+	if first, err := links.GetLink("taken"); err != nil || string(first.Request.Request) != "GET /first" {
+		t.Fatalf("the link that was already there was replaced: %+v, %v", first, err)
+	}
+
+	//a server that keeps picking taken ids gives up
+	generateLinkId = func(length int) (string, error) {
+		return "taken", nil
+	}
+	if _, err := shortenedUrls.addNewShortenURL(BurpRequestResponse{}, &linkOptions{}); err == nil {
+		t.Fatal("a link was created without an unused id")
+	}
+}
+
+func TestLinksUseTheFirstHost(t *testing.T) {
+	config := &ServerConfig{Host: "teamserver.example,10.0.0.1", Port: "9999", ShortenerIdLength: MinShortenerIdLength, DataDir: t.TempDir()}
+	links, err := NewLinkStore(filepath.Join(config.DataDir, "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer links.Close()
+	shortenedUrls, err := NewShortenedUrls(config, links, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if linkURL := shortenedUrls.linkURL("id"); linkURL != "https://teamserver.example:9999"+ShortenerPath+"?id=id" {
+		t.Fatalf("links point at %s", linkURL)
+	}
+}
+
+func TestHashOnlyLinksAreRefusedOverHttp(t *testing.T) {
+	config := &ServerConfig{Host: "teamserver.example", Port: "9999", ShortenerIdLength: MinShortenerIdLength, DataDir: t.TempDir()}
+	links, err := NewLinkStore(filepath.Join(config.DataDir, "links.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer links.Close()
+	shortenedUrls, err := NewShortenedUrls(config, links, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	apiKey, err := shortenedUrls.getUrlShortenerApiKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	post := func(body string) *fasthttp.RequestCtx {
+		ctx := &fasthttp.RequestCtx{}
+		ctx.Request.Header.SetMethod(fasthttp.MethodPost)
+		ctx.Request.SetRequestURI(ShortenerPath + "?key=" + apiKey)
+		ctx.Request.SetBodyString(body)
+		shortenedUrls.HandleShortUrl(ctx)
+		return ctx
+	}
+	ctx := post(`{"request":[],"requestHash":"` + strings.Repeat("a", 64) + `"}`)
+	if ctx.Response.StatusCode() != fasthttp.StatusBadRequest || !strings.Contains(string(ctx.Response.Body()), "inline") {
+		t.Fatalf("a hash-only request got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+	if ctx := post(`{"request":[71,69,84],"requestHash":"` + strings.Repeat("a", 64) + `"}`); ctx.Response.StatusCode() != fasthttp.StatusOK {
+		t.Fatalf("an inline request got %d: %s", ctx.Response.StatusCode(), ctx.Response.Body())
+	}
+}
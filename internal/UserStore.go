@@ -0,0 +1,210 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const UsersFileName = "users.json"
+
+// unknown usernames are checked against this hash so they take as long to refuse as a wrong password
+var (
+	unknownUserHash     []byte
+	unknownUserHashOnce sync.Once
+)
+
+func getUnknownUserHash() []byte {
+	unknownUserHashOnce.Do(func() {
+		unknownUserHash, _ = bcrypt.GenerateFromPassword([]byte("unknown user"), bcrypt.DefaultCost)
+	})
+	return unknownUserHash
+}
+
+// UserStore keeps the user accounts. The file is reread when it changes, so accounts removed or reset from the
+// command line take effect in a running server
+type UserStore struct {
+	path     string
+	lock     sync.Mutex
+	users    map[string][]byte
+	modified time.Time
+	//users removed or reset since Reload was last called
+	changed map[string]bool
+}
+
+type userFile struct {
+	Users map[string]string `json:"users"`
+}
+
+func LoadUserStore(path string) (*UserStore, error) {
+	store := &UserStore{
+		path:    path,
+		users:   make(map[string][]byte),
+		changed: make(map[string]bool),
+	}
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store, store.reload()
+}
+
+// rereads the file if it changed since it was last read. Must hold the lock
+func (u *UserStore) reload() error {
+	fileInfo, err := os.Stat(u.path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fileInfo.ModTime().Equal(u.modified) {
+		return nil
+	}
+	fileBytes, err := ioutil.ReadFile(u.path)
+	if err != nil {
+		return err
+	}
+	stored := userFile{}
+	if err := json.Unmarshal(fileBytes, &stored); err != nil {
+		return err
+	}
+	users := make(map[string][]byte)
+	for username, passwordHash := range stored.Users {
+		users[username] = []byte(passwordHash)
+	}
+	for username, passwordHash := range u.users {
+		if !bytes.Equal(users[username], passwordHash) {
+			u.changed[username] = true
+		}
+	}
+	u.users = users
+	u.modified = fileInfo.ModTime()
+	return nil
+}
+
+// Reload rereads the file if it changed and returns the users removed or reset since the last call, so a running
+// server can disconnect them
+func (u *UserStore) Reload() ([]string, error) {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.reload(); err != nil {
+		return nil, err
+	}
+	changed := make([]string, 0, len(u.changed))
+	for username := range u.changed {
+		changed = append(changed, username)
+	}
+	u.changed = make(map[string]bool)
+	return changed, nil
+}
+
+// Must hold the lock
+func (u *UserStore) save() error {
+	stored := userFile{Users: make(map[string]string)}
+	for username, passwordHash := range u.users {
+		stored.Users[username] = string(passwordHash)
+	}
+	fileBytes, err := json.MarshalIndent(stored, "", "  ")
+	if err != nil {
+		return err
+	}
+	//write to a temporary file first so a crash never leaves a half written user list
+	if err := ioutil.WriteFile(u.path+".tmp", fileBytes, 0600); err != nil {
+		return err
+	}
+	if err := os.Rename(u.path+".tmp", u.path); err != nil {
+		return err
+	}
+	if fileInfo, err := os.Stat(u.path); err == nil {
+		u.modified = fileInfo.ModTime()
+	}
+	return nil
+}
+
+func validateUsername(username string) error {
+	if len(username) == 0 {
+		return errors.New("username cannot be empty")
+	}
+	if strings.ContainsAny(username, "#,:") {
+		return errors.New("username cannot contain '#', ',' or ':'")
+	}
+	return nil
+}
+
+func (u *UserStore) AddUser(username string, password string) error {
+	if err := validateUsername(username); err != nil {
+		return err
+	}
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.reload(); err != nil {
+		return err
+	}
+	if _, ok := u.users[username]; ok {
+		return errors.New("user " + username + " already exists")
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.users[username] = passwordHash
+	return u.save()
+}
+
+func (u *UserStore) RemoveUser(username string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.reload(); err != nil {
+		return err
+	}
+	if _, ok := u.users[username]; !ok {
+		return errors.New("user " + username + " does not exist")
+	}
+	delete(u.users, username)
+	return u.save()
+}
+
+func (u *UserStore) ResetPassword(username string, password string) error {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.reload(); err != nil {
+		return err
+	}
+	if _, ok := u.users[username]; !ok {
+		return errors.New("user " + username + " does not exist")
+	}
+	passwordHash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return err
+	}
+	u.users[username] = passwordHash
+	return u.save()
+}
+
+func (u *UserStore) Authenticate(username string, password string) bool {
+	u.lock.Lock()
+	if err := u.reload(); err != nil {
+		log.Printf("could not reload users, using the last list read: %s", err)
+	}
+	passwordHash, ok := u.users[username]
+	u.lock.Unlock()
+	if !ok {
+		_ = bcrypt.CompareHashAndPassword(getUnknownUserHash(), []byte(password))
+		return false
+	}
+	return bcrypt.CompareHashAndPassword(passwordHash, []byte(password)) == nil
+}
+
+func (u *UserStore) HasUsers() bool {
+	u.lock.Lock()
+	defer u.lock.Unlock()
+	if err := u.reload(); err != nil {
+		log.Printf("could not reload users, using the last list read: %s", err)
+	}
+	return len(u.users) > 0
+}
@@ -2,11 +2,19 @@ package internal
 
 import (
 	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
 	"math"
 	"math/big"
+	"strconv"
+	"strings"
 )
 
 func remove(s []string, i int) []string {
+	//i is -1 when index didn't find anything to remove
+	if i < 0 {
+		return s
+	}
 	s[i] = s[len(s)-1]
 	return s[:len(s)-1]
 }
@@ -43,6 +51,22 @@ func generateRandomUserNumber() (int, error) {
 	return randomNumberInt, nil
 }
 
+const charset = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// picks each character with crypto/rand so the result can be used as a secret
+func generateRandomString(length int) (string, error) {
+	b := make([]byte, length)
+	charsetSize := big.NewInt(int64(len(charset)))
+	for i := range b {
+		charIndex, err := rand.Int(rand.Reader, charsetSize)
+		if err != nil {
+			return "", err
+		}
+		b[i] = charset[charIndex.Int64()]
+	}
+	return string(b), nil
+}
+
 func generateMessage(burpTCMessage *BurpTCMessage, sender *Client, roomName string) *Message {
 	return &Message{
 		msg:      burpTCMessage,
@@ -50,3 +74,34 @@ func generateMessage(burpTCMessage *BurpTCMessage, sender *Client, roomName stri
 		roomName: roomName,
 	}
 }
+
+// parses "offset:limit" history request data, either part may be omitted
+func parseHistoryPageData(data string) (int, int) {
+	offset, limit := 0, defaultHistoryPageSize
+	pageData := strings.Split(data, ":")
+	if parsedOffset, err := strconv.Atoi(pageData[0]); err == nil && parsedOffset > 0 {
+		offset = parsedOffset
+	}
+	if len(pageData) > 1 {
+		if parsedLimit, err := strconv.Atoi(pageData[1]); err == nil && parsedLimit > 0 && parsedLimit <= defaultHistoryPageSize {
+			limit = parsedLimit
+		}
+	}
+	return offset, limit
+}
+
+func generateCommentId() (string, error) {
+	idBytes := make([]byte, 8)
+	if _, err := rand.Read(idBytes); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(idBytes), nil
+}
+
+func GeneratePassword() (string, error) {
+	passwordBytes := make([]byte, 18)
+	if _, err := rand.Read(passwordBytes); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(passwordBytes), nil
+}
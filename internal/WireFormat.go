@@ -0,0 +1,62 @@
+package internal
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"github.com/fasthttp/websocket"
+	"github.com/vmihailenco/msgpack/v5"
+	"log"
+)
+
+// WireProtocolV2 is the websocket subprotocol clients request at upgrade to send and receive BurpTCMessages as
+// msgpack in binary frames, with request and response bytes sent as is. Clients that don't ask for it get the
+// legacy base64 encoded JSON text frames
+const WireProtocolV2 = "burp-tc-v2"
+
+// reads a websocket frame from a client using the wire format it negotiated
+func decodeBurpTCMessage(binary bool, frameType int, frame []byte) (*BurpTCMessage, *ClientError) {
+	newBurpMessage := NewBurpTCMessage()
+	if binary {
+		if frameType != websocket.BinaryMessage {
+			return newBurpMessage, newClientError(ErrorBadPayload, "%s messages must be sent as binary frames", WireProtocolV2)
+		}
+		decoder := msgpack.NewDecoder(bytes.NewReader(frame))
+		decoder.SetCustomStructTag("json")
+		if err := decoder.Decode(newBurpMessage); err != nil {
+			log.Printf("Could not unmarshal BurpTCMessage, error: %s \n", err)
+			return NewBurpTCMessage(), newClientError(ErrorBadPayload, "message is not a valid BurpTCMessage")
+		}
+		return newBurpMessage, nil
+	}
+	decodedBytes := make([]byte, base64.StdEncoding.DecodedLen(len(frame)))
+	if _, err := base64.StdEncoding.Decode(decodedBytes, frame); err != nil {
+		log.Printf("error decoding base64: %v", err)
+		return newBurpMessage, newClientError(ErrorBadPayload, "message is not valid base64")
+	}
+	if err := json.Unmarshal(bytes.Trim(decodedBytes, "\x00"), newBurpMessage); err != nil {
+		log.Printf("Could not unmarshal BurpTCMessage, error: %s \n", err)
+		return NewBurpTCMessage(), newClientError(ErrorBadPayload, "message is not a valid BurpTCMessage")
+	}
+	return newBurpMessage, nil
+}
+
+// builds the websocket frame for a client using the wire format it negotiated
+func encodeBurpTCMessage(binary bool, msg *BurpTCMessage) (int, []byte, error) {
+	if binary {
+		var frame bytes.Buffer
+		encoder := msgpack.NewEncoder(&frame)
+		encoder.SetCustomStructTag("json")
+		if err := encoder.Encode(msg); err != nil {
+			return 0, nil, err
+		}
+		return websocket.BinaryMessage, frame.Bytes(), nil
+	}
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return 0, nil, err
+	}
+	encodedBuf := make([]byte, base64.StdEncoding.EncodedLen(len(jsonBytes)))
+	base64.StdEncoding.Encode(encodedBuf, jsonBytes)
+	return websocket.TextMessage, encodedBuf, nil
+}
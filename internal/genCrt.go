@@ -1,15 +1,18 @@
 package internal
 
 import (
+	"crypto"
 	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
 	"crypto/x509/pkix"
-	"encoding/asn1"
 	"encoding/pem"
-	"flag"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"math/big"
 	"net"
@@ -18,11 +21,19 @@ import (
 	"time"
 )
 
-type PKCS8Key struct {
-	Version             int
-	PrivateKeyAlgorithm []asn1.ObjectIdentifier
-	PrivateKey          []byte
-}
+// where the server's certificate is kept unless configured otherwise. The generated one is also the CA that issues
+// client certificates
+const (
+	ServerCertFile     = "./burpServer.pem"
+	ServerKeyFile      = "./burpServer.key"
+	serverCertValidity = 365 * 24 * time.Hour
+)
+
+// key types the server certificate can be generated with
+const (
+	KeyTypeRSA   = "rsa"
+	KeyTypeECDSA = "ecdsa"
+)
 
 func publicKey(priv interface{}) interface{} {
 	switch k := priv.(type) {
@@ -40,49 +51,100 @@ func Bod(t time.Time) time.Time {
 	return time.Date(year, month, day, 0, 0, 0, 0, t.Location())
 }
 
-func MarshalPKCS8PrivateKey(key *rsa.PrivateKey) ([]byte, error) {
-	var pkey PKCS8Key
-	pkey.Version = 0
-	pkey.PrivateKeyAlgorithm = make([]asn1.ObjectIdentifier, 1)
-	pkey.PrivateKeyAlgorithm[0] = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
-	pkey.PrivateKey = x509.MarshalPKCS1PrivateKey(key)
-	return asn1.Marshal(pkey)
+// generates a 2048 bit RSA or P-256 ECDSA key
+func generateKey(keyType string) (crypto.Signer, error) {
+	switch keyType {
+	case KeyTypeRSA:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case KeyTypeECDSA:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	}
+	return nil, fmt.Errorf("unknown key type %q, use %s or %s", keyType, KeyTypeRSA, KeyTypeECDSA)
+}
+
+// returns the type of an existing key so a renewed one can match it
+func keyTypeOf(priv crypto.Signer) string {
+	if _, ok := priv.(*ecdsa.PrivateKey); ok {
+		return KeyTypeECDSA
+	}
+	return KeyTypeRSA
 }
 
-func GenCrt(host string) {
-	flag.Parse()
+// GenCrt creates a self-signed CA certificate for the server with a keyType key if there isn't one at certFile yet
+func GenCrt(host string, certFile string, keyFile string, keyType string) {
 	if len(host) == 0 {
 		log.Fatalf("Missing required host parameter")
 	}
-	_, err := os.Stat("./burpServer.pem")
+	_, err := os.Stat(certFile)
 	if err == nil {
-		fmt.Println("file", "burpServer.pem found no need to generate new key")
+		fmt.Println("file", certFile, "found no need to generate new key")
 		return
 	} else {
 		fmt.Println("creating new certificates")
 	}
 
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	priv, err := generateKey(keyType)
 	if err != nil {
 		log.Fatalf("failed to generate private key: %s", err)
 	}
+	if _, err := writeServerCert(strings.Split(host, ","), priv, certFile, keyFile, serverCertValidity); err != nil {
+		log.Fatalf("Failed to create certificate: %s", err)
+	}
+}
 
-	pkcs8Bytes, err := MarshalPKCS8PrivateKey(priv)
+// RotateCert replaces the server certificate with a new one. Unless newKey is set the new certificate keeps the old
+// key and subject, so the client certificates it issued stay valid. A new key is of keyType, or the old key's type
+// if it is empty. The hosts of the old certificate are kept when host is empty
+func RotateCert(host string, certFile string, keyFile string, validity time.Duration, newKey bool, keyType string) (*x509.Certificate, error) {
+	oldPair, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	oldCert, err := x509.ParseCertificate(oldPair.Certificate[0])
 	if err != nil {
-		log.Fatalf("failed to convert private key to PKCS8: %s", err)
+		return nil, err
+	}
+	if !oldCert.IsCA {
+		return nil, errors.New(certFile + " was not generated by this server, replace it with a renewed certificate of your own")
+	}
+	hosts := oldCert.DNSNames
+	for _, ip := range oldCert.IPAddresses {
+		hosts = append(hosts, ip.String())
+	}
+	if len(host) > 0 {
+		hosts = strings.Split(host, ",")
 	}
+	priv, ok := oldPair.PrivateKey.(crypto.Signer)
+	if !ok {
+		return nil, errors.New("unsupported private key type")
+	}
+	if newKey {
+		if len(keyType) == 0 {
+			keyType = keyTypeOf(priv)
+		}
+		if priv, err = generateKey(keyType); err != nil {
+			return nil, err
+		}
+	} else if len(keyType) > 0 && keyType != keyTypeOf(priv) {
+		return nil, errors.New("the key type can only be changed along with the key")
+	}
+	return writeServerCert(hosts, priv, certFile, keyFile, validity)
+}
 
+// writes a self-signed CA certificate for hosts and its key, replacing the files in one step each so a running
+// server never loads half of them
+func writeServerCert(hosts []string, priv crypto.Signer, certFile string, keyFile string, validity time.Duration) (*x509.Certificate, error) {
 	notBefore, err := time.Parse("Mon Jan _2 15:04:05 2006", time.Now().Format("Mon Jan _2 15:04:05 2006"))
 	if err != nil {
-		log.Fatalf("Failed to parse creation date: %s\n", err)
+		return nil, err
 	}
 	notBefore = Bod(notBefore)
-	notAfter := notBefore.Add(365 * 24 * time.Hour)
+	notAfter := notBefore.Add(validity)
 
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
-		log.Fatalf("failed to generate serial number: %s", err)
+		return nil, err
 	}
 
 	template := x509.Certificate{
@@ -93,12 +155,17 @@ func GenCrt(host string) {
 		NotBefore: notBefore,
 		NotAfter:  notAfter,
 
-		KeyUsage:              x509.KeyUsageKeyEncipherment | x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
 		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
 		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	//only RSA keys are used to encrypt the key exchange
+	if _, ok := priv.(*rsa.PrivateKey); ok {
+		template.KeyUsage |= x509.KeyUsageKeyEncipherment
 	}
 
-	hosts := strings.Split(host, ",")
 	for _, h := range hosts {
 		if ip := net.ParseIP(h); ip != nil {
 			template.IPAddresses = append(template.IPAddresses, ip)
@@ -107,41 +174,28 @@ func GenCrt(host string) {
 		}
 	}
 
-	template.IsCA = true
-	template.KeyUsage |= x509.KeyUsageCertSign
-
 	derBytes, err := x509.CreateCertificate(rand.Reader, &template, &template, publicKey(priv), priv)
 	if err != nil {
-		log.Fatalf("Failed to create certificate: %s", err)
+		return nil, err
 	}
-
-	certOut, err := os.Create("burpServer.pem")
+	keyBytes, err := x509.MarshalPKCS8PrivateKey(priv)
 	if err != nil {
-		log.Fatalf("failed to open burpServer.pem for writing: %s", err)
+		return nil, err
 	}
-	if err = pem.Encode(certOut, &pem.Block{Type: "CERTIFICATE", Bytes: derBytes}); err != nil {
-		log.Fatalln(err)
+	if err := writeFileAtomically(keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyBytes}), 0600); err != nil {
+		return nil, err
 	}
-	if err = certOut.Close(); err != nil {
-		log.Fatalln(err)
+	log.Printf("written %s", keyFile)
+	if err := writeFileAtomically(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: derBytes}), 0644); err != nil {
+		return nil, err
 	}
-	log.Print("written burpServer.pem\n")
+	log.Printf("written %s", certFile)
+	return x509.ParseCertificate(derBytes)
+}
 
-	keyOut, err := os.OpenFile("burpServer.key", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
-	if err != nil {
-		log.Print("failed to open burpServer.key for writing:", err)
-		return
-	}
-	if err = pem.Encode(keyOut,
-		&pem.Block{
-			Type:  "PRIVATE KEY",
-			Bytes: pkcs8Bytes,
-		},
-	); err != nil {
-		log.Fatalln(err)
-	}
-	if err = keyOut.Close(); err != nil {
-		log.Fatalln(err)
+func writeFileAtomically(path string, data []byte, perm os.FileMode) error {
+	if err := ioutil.WriteFile(path+".tmp", data, perm); err != nil {
+		return err
 	}
-	log.Print("written burpServer.key\n")
+	return os.Rename(path+".tmp", path)
 }
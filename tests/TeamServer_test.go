@@ -1,25 +1,70 @@
 package tests
 
 import (
+	"bytes"
+	"crypto/sha256"
 	"crypto/tls"
 	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"github.com/Static-Flow/BurpSuiteTeamServer/internal"
 	"github.com/fasthttp/websocket"
+	"github.com/vmihailenco/msgpack/v5"
 	"io/ioutil"
 	"math/rand"
+	"net"
 	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 )
 
-func TestStartServerConnection(t *testing.T) {
+const (
+	testHost = "localhost"
+	testPort = "9999"
+)
+
+var startServerOnce sync.Once
+
+// data directory of the shared test server
+var testDataDir string
 
+// starts one server shared by every test and returns a dialer trusting its certificate
+func startTestServer(t testing.TB) websocket.Dialer {
+	startServerOnce.Do(func() {
+		var err error
+		if testDataDir, err = ioutil.TempDir("", "BurpSuiteTeamServer"); err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			_ = internal.StartServer(&internal.ServerConfig{
+				Host:               testHost,
+				Port:               testPort,
+				EnableUrlShortener: true,
+				ShortenerIdLength:  internal.MinShortenerIdLength,
+				DataDir:            testDataDir,
+				MaxMessageSize:     1 << 20,
+			})
+		}()
+		for i := 0; i < 100; i++ {
+			if conn, err := net.Dial("tcp", testHost+":"+testPort); err == nil {
+				_ = conn.Close()
+				break
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+	})
 	caCert, _ := ioutil.ReadFile("./burpServer.pem")
 	caCertPool := x509.NewCertPool()
 	caCertPool.AppendCertsFromPEM(caCert)
 	crt, _ := tls.LoadX509KeyPair("./burpServer.pem", "./burpServer.key")
-	wsDialer := websocket.Dialer{
+	return websocket.Dialer{
 		ReadBufferSize:  1024,
 		WriteBufferSize: 1024,
 		Subprotocols:    []string{"p1", "p2"},
@@ -28,17 +73,11 @@ func TestStartServerConnection(t *testing.T) {
 			RootCAs:      caCertPool,
 		},
 	}
-	var passwd, host, shortPort, srvPort string
-	enableShort := false
-	passwd = ""
-	host = "localhost"
-	shortPort = "8080"
-	srvPort = "9999"
-	//var hub *internal.ServerHub
-	go func() {
-		_ = internal.StartServer(&passwd, &host, &enableShort, &shortPort, &srvPort)
-	}()
-	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", host, srvPort), http.Header{"Username": {randSeq(10)}})
+}
+
+func TestStartServerConnection(t *testing.T) {
+	wsDialer := startTestServer(t)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
 	if err != nil {
 		t.Error(err)
 	} else {
@@ -47,6 +86,1688 @@ func TestStartServerConnection(t *testing.T) {
 
 }
 
+func TestHelloHandshake(t *testing.T) {
+	wsDialer := startTestServer(t)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	sendAndAwait(t, ws, &internal.BurpTCMessage{MessageType: "HELLO_MESSAGE", Data: "not json"}, "ERROR_MESSAGE")
+
+	clientHello, _ := json.Marshal(&internal.ClientHello{Version: internal.ProtocolVersion + 1, Features: []string{"somethingNew"}})
+	if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "HELLO_MESSAGE", Data: string(clientHello)}); err != nil {
+		t.Fatal(err)
+	}
+	serverHello := &internal.ServerHello{}
+	if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, ws, "HELLO_MESSAGE").Data), serverHello); err != nil {
+		t.Fatal(err)
+	}
+	if serverHello.Version != internal.ProtocolVersion {
+		t.Errorf("server sent version %d, expected %d", serverHello.Version, internal.ProtocolVersion)
+	}
+	supported := map[string]bool{}
+	for _, messageType := range serverHello.MessageTypes {
+		supported[messageType] = true
+	}
+	for _, messageType := range []string{"HELLO_MESSAGE", "JOIN_ROOM_MESSAGE", "BURP_MESSAGE", "GET_BLOB_MESSAGE", "GET_LINKS_MESSAGE"} {
+		if !supported[messageType] {
+			t.Errorf("server did not advertise %s in %v", messageType, serverHello.MessageTypes)
+		}
+	}
+	//the test server stores data and runs the shortener
+	features := strings.Join(serverHello.Features, ",")
+	for _, feature := range []string{"blobs", "history", "persistentRooms", "shortener"} {
+		if !strings.Contains(features, feature) {
+			t.Errorf("server did not advertise %s in %v", feature, serverHello.Features)
+		}
+	}
+	if serverHello.Limits.HistoryPageSize == 0 || serverHello.Limits.MaxRoomNameLength == 0 {
+		t.Errorf("server did not advertise its limits: %+v", serverHello.Limits)
+	}
+}
+
+func TestChunkedTransfer(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "chunks" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	sender, receiver, legacyReceiver := clients[0], clients[1], clients[2]
+	clientHello, _ := json.Marshal(&internal.ClientHello{Version: internal.ProtocolVersion, Features: []string{"chunkedTransfers"}})
+	sendAndAwait(t, receiver, &internal.BurpTCMessage{MessageType: "HELLO_MESSAGE", Data: string(clientHello)}, "HELLO_MESSAGE")
+	sendAndAwait(t, sender, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, receiver, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	sendAndAwait(t, legacyReceiver, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	//too big for one message, but the connection stays open
+	tooLarge := &internal.BurpTCMessage{MessageType: "BURP_MESSAGE", BurpRequestResponse: &internal.BurpRequestResponse{Response: bytes.Repeat([]byte{'A'}, 1<<20)}}
+	sendAndAwait(t, sender, tooLarge, "ERROR_MESSAGE")
+
+	//the default rules redact the Authorization header, which is split between the first two chunks
+	request := internal.BurpBytes("POST /upload HTTP/1.1\r\nAuthorization: Bearer hunter2\r\n\r\n")
+	redactedRequest := "POST /upload HTTP/1.1\r\nAuthorization: " + internal.RedactedPlaceholder + "\r\n\r\n"
+	response := append([]byte("HTTP/1.1 200 OK\r\n\r\n"), bytes.Repeat([]byte("0123456789"), 300)...)
+	requestParts := [][]byte{request[:30], request[30:], nil}
+	responseParts := [][]byte{response[:1000], response[1000:2000], response[2000:]}
+	chunkMessage := func(index int) *internal.BurpTCMessage {
+		chunk, _ := json.Marshal(&internal.TransferChunk{
+			TransferId:   "transfer",
+			MessageType:  "BURP_MESSAGE",
+			Index:        index,
+			Count:        3,
+			RequestSize:  len(request),
+			ResponseSize: len(response),
+		})
+		burpRequestResponse := &internal.BurpRequestResponse{Request: requestParts[index], Response: responseParts[index]}
+		if index == 0 {
+			burpRequestResponse.HttpService = &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"}
+		}
+		return &internal.BurpTCMessage{
+			MessageType:         "CHUNK_MESSAGE",
+			Data:                string(chunk),
+			BurpRequestResponse: burpRequestResponse,
+		}
+	}
+	sendAndAwait(t, sender, chunkMessage(1), "ERROR_MESSAGE")
+
+	//chunks are relayed as they arrive, holding back a head only until it is complete and redacted
+	var reassembledRequest, reassembled []byte
+	for i := 0; i < 3; i++ {
+		if err := sendBurpTCMessage(sender, chunkMessage(i)); err != nil {
+			t.Fatal(err)
+		}
+		part := awaitBurpTCMessage(t, receiver, "CHUNK_MESSAGE").BurpRequestResponse
+		if i == 0 && (len(part.Request) != 0 || len(part.Response) != 1000 || part.HttpService == nil) {
+			t.Fatalf("first chunk relayed %q and %d response bytes", part.Request, len(part.Response))
+		}
+		reassembledRequest = append(reassembledRequest, part.Request...)
+		reassembled = append(reassembled, part.Response...)
+	}
+	if string(reassembledRequest) != redactedRequest {
+		t.Fatalf("chunks were relayed with the request %q", reassembledRequest)
+	}
+	if !bytes.Equal(reassembled, response) {
+		t.Fatalf("reassembled %d bytes that don't match the %d sent", len(reassembled), len(response))
+	}
+
+	//clients that don't know about chunks get the whole message, and so does history
+	whole := awaitBurpTCMessage(t, legacyReceiver, "BURP_MESSAGE").BurpRequestResponse
+	if string(whole.Request) != redactedRequest || !bytes.Equal(whole.Response, response) || whole.HttpService == nil || whole.HttpService.Host != "example.com" {
+		t.Fatalf("legacy client got %d request and %d response bytes for %+v", len(whole.Request), len(whole.Response), whole.HttpService)
+	}
+	if err := sendBurpTCMessage(legacyReceiver, &internal.BurpTCMessage{MessageType: "GET_HISTORY_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	page := &internal.HistoryPage{}
+	if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, legacyReceiver, "HISTORY_MESSAGE").Data), page); err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 1 || page.Entries[0].Message.MessageType != "BURP_MESSAGE" || !bytes.Equal(page.Entries[0].Message.BurpRequestResponse.Response, response) {
+		t.Fatalf("history holds %+v instead of the whole message", page)
+	}
+
+	//patterns can match across chunks, so rooms that redact with them put the chunks back together first
+	sendAndAwait(t, sender, &internal.BurpTCMessage{MessageType: "SET_REDACTION_MESSAGE", Data: `{"patterns": ["secret=(\\w+)"]}`}, "SET_REDACTION_MESSAGE")
+	for i, part := range []string{"POST / HTTP/1.1\r\n\r\nsec", "ret=hunter2"} {
+		chunk, _ := json.Marshal(&internal.TransferChunk{TransferId: "redacted", MessageType: "BURP_MESSAGE", Index: i, Count: 2, RequestSize: 33})
+		if err := sendBurpTCMessage(sender, &internal.BurpTCMessage{
+			MessageType:         "CHUNK_MESSAGE",
+			Data:                string(chunk),
+			BurpRequestResponse: &internal.BurpRequestResponse{Request: internal.BurpBytes(part)},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for {
+		msg, err := readBurpTCMessage(receiver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.MessageType == "CHUNK_MESSAGE" {
+			t.Fatalf("a room that redacts passed on chunk %s", msg.Data)
+		}
+		if msg.MessageType == "BURP_MESSAGE" {
+			if redacted := string(msg.BurpRequestResponse.Request); redacted != "POST / HTTP/1.1\r\n\r\nsecret="+internal.RedactedPlaceholder {
+				t.Fatalf("reassembled request was shared as %q", redacted)
+			}
+			break
+		}
+	}
+}
+
+func TestBlobReferences(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "blobs" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	blobClient, legacyClient := clients[0], clients[1]
+	clientHello, _ := json.Marshal(&internal.ClientHello{Version: internal.ProtocolVersion, Features: []string{"blobs"}})
+	sendAndAwait(t, blobClient, &internal.BurpTCMessage{MessageType: "HELLO_MESSAGE", Data: string(clientHello)}, "HELLO_MESSAGE")
+	sendAndAwait(t, blobClient, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, legacyClient, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	response := internal.BurpBytes("HTTP/1.1 200 OK\r\n\r\n" + randSeq(100))
+	if err := sendBurpTCMessage(legacyClient, &internal.BurpTCMessage{
+		MessageType:         "BURP_MESSAGE",
+		BurpRequestResponse: &internal.BurpRequestResponse{Request: internal.BurpBytes("GET / HTTP/1.1\r\n\r\n"), Response: response},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	referenced := awaitBurpTCMessage(t, blobClient, "BURP_MESSAGE").BurpRequestResponse
+	if len(referenced.Response) != 0 || len(referenced.ResponseHash) == 0 {
+		t.Fatalf("expected the response by reference only, got %v", referenced)
+	}
+	sendAndAwait(t, blobClient, &internal.BurpTCMessage{MessageType: "GET_BLOB_MESSAGE", Data: strings.Repeat("0", 64)}, "ERROR_MESSAGE")
+	if err := sendBurpTCMessage(blobClient, &internal.BurpTCMessage{MessageType: "GET_BLOB_MESSAGE", Data: referenced.ResponseHash}); err != nil {
+		t.Fatal(err)
+	}
+	if blob := awaitBurpTCMessage(t, blobClient, "BLOB_MESSAGE").Blob; !bytes.Equal(blob, response) {
+		t.Fatalf("fetched blob %q instead of %q", blob, response)
+	}
+
+	//sharing it again by hash reaches the legacy client with the body inline
+	if err := sendBurpTCMessage(blobClient, &internal.BurpTCMessage{MessageType: "REPEATER_MESSAGE", BurpRequestResponse: referenced}); err != nil {
+		t.Fatal(err)
+	}
+	if inline := awaitBurpTCMessage(t, legacyClient, "REPEATER_MESSAGE").BurpRequestResponse; !bytes.Equal(inline.Response, response) {
+		t.Fatalf("legacy client got %q instead of %q", inline.Response, response)
+	}
+
+	//bodies can't be fetched or shared by hash from another room
+	outsider, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer outsider.Close()
+	sendAndAwait(t, outsider, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: "other" + roomName}, "NEW_MEMBER_MESSAGE")
+	for _, message := range []*internal.BurpTCMessage{
+		{MessageType: "GET_BLOB_MESSAGE", Data: referenced.ResponseHash},
+		{MessageType: "REPEATER_MESSAGE", BurpRequestResponse: referenced},
+	} {
+		if err := sendBurpTCMessage(outsider, message); err != nil {
+			t.Fatal(err)
+		}
+		if reply := awaitBurpTCMessage(t, outsider, "ERROR_MESSAGE"); !strings.Contains(reply.Data, internal.ErrorBlobNotFound) {
+			t.Errorf("%s from another room got %s", message.MessageType, reply.Data)
+		}
+	}
+
+	//and they go when the room does
+	blobDir := filepath.Join(testDataDir, "blobs", hex.EncodeToString([]byte(roomName)))
+	if _, err := os.Stat(blobDir); err != nil {
+		t.Fatalf("room blobs are missing: %s", err)
+	}
+	if err := sendBurpTCMessage(blobClient, &internal.BurpTCMessage{MessageType: "DELETE_ROOM_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	sendAndAwait(t, blobClient, &internal.BurpTCMessage{MessageType: "GET_ROOMS_MESSAGE"}, "GET_ROOMS_MESSAGE")
+	if _, err := os.Stat(blobDir); !os.IsNotExist(err) {
+		t.Fatalf("blobs of a deleted room were kept: %v", err)
+	}
+}
+
+func TestSlowClientDoesNotStallRoom(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "flood" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	sender, receiver, slowClient := clients[0], clients[1], clients[2]
+
+	sendAndAwait(t, sender, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, receiver, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	//the slow client never reads again after joining
+	sendAndAwait(t, slowClient, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	//the sender keeps reading, without a deadline, so the server's pings are answered however long the flood takes
+	go func() {
+		_ = sender.SetReadDeadline(time.Time{})
+		for {
+			if _, _, err := sender.ReadMessage(); err != nil {
+				return
+			}
+		}
+	}()
+	var received int64
+	go func() {
+		for {
+			msg, err := readBurpTCMessage(receiver)
+			if err != nil {
+				return
+			}
+			if msg.MessageType == "BURP_MESSAGE" {
+				atomic.AddInt64(&received, 1)
+			}
+		}
+	}()
+
+	request := internal.BurpBytes(bytes.Repeat([]byte{'A'}, 4096))
+	floodMessage := &internal.BurpTCMessage{
+		MessageType: "BURP_MESSAGE",
+		BurpRequestResponse: &internal.BurpRequestResponse{
+			Request:     request,
+			HttpService: &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"},
+		},
+	}
+	//enough messages to overflow the slow client's socket and send buffer several times over
+	const floodMessages = 2500
+	for i := 1; i <= floodMessages; i++ {
+		if err := sendBurpTCMessage(sender, floodMessage); err != nil {
+			t.Fatal(err)
+		}
+		if i%100 == 0 {
+			deadline := time.Now().Add(20 * time.Second)
+			for atomic.LoadInt64(&received) < int64(i) {
+				if time.Now().After(deadline) {
+					t.Fatalf("receiver stalled at %d of %d messages", atomic.LoadInt64(&received), i)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+	}
+}
+
+// many busy rooms at once, each room has one sender and a few receivers
+func BenchmarkManyRooms(b *testing.B) {
+	const (
+		rooms            = 16
+		receiversPerRoom = 3
+	)
+	wsDialer := startTestServer(b)
+	var senders []*websocket.Conn
+	var received int64
+	for r := 0; r < rooms; r++ {
+		roomName := "bench" + randSeq(6)
+		for c := 0; c <= receiversPerRoom; c++ {
+			ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer ws.Close()
+			if c == 0 {
+				sendAndAwait(b, ws, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+				senders = append(senders, ws)
+				continue
+			}
+			sendAndAwait(b, ws, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+			go func(ws *websocket.Conn) {
+				for {
+					msg, err := readBurpTCMessage(ws)
+					if err != nil {
+						return
+					}
+					if msg.MessageType == "BURP_MESSAGE" {
+						atomic.AddInt64(&received, 1)
+					}
+				}
+			}(ws)
+		}
+	}
+	message := &internal.BurpTCMessage{
+		MessageType: "BURP_MESSAGE",
+		BurpRequestResponse: &internal.BurpRequestResponse{
+			Request:     internal.BurpBytes("GET /"),
+			HttpService: &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"},
+		},
+	}
+	perRoom := b.N/rooms + 1
+
+	b.ResetTimer()
+	start := time.Now()
+	var wg sync.WaitGroup
+	for _, sender := range senders {
+		wg.Add(1)
+		go func(sender *websocket.Conn) {
+			defer wg.Done()
+			for i := 0; i < perRoom; i++ {
+				if err := sendBurpTCMessage(sender, message); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		}(sender)
+	}
+	wg.Wait()
+	expected := int64(rooms * perRoom * receiversPerRoom)
+	deadline := time.Now().Add(time.Minute)
+	for atomic.LoadInt64(&received) < expected {
+		if time.Now().After(deadline) {
+			b.Fatalf("only %d of %d messages delivered", atomic.LoadInt64(&received), expected)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.StopTimer()
+	b.ReportMetric(float64(expected)/time.Since(start).Seconds(), "msgs/sec")
+}
+
+func TestBinaryWireFormat(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "binary" + randSeq(6)
+	legacyClient, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer legacyClient.Close()
+	wsDialer.Subprotocols = []string{internal.WireProtocolV2}
+	binaryClient, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer binaryClient.Close()
+	if binaryClient.Subprotocol() != internal.WireProtocolV2 {
+		t.Fatalf("server negotiated %q instead of %s", binaryClient.Subprotocol(), internal.WireProtocolV2)
+	}
+
+	sendAndAwait(t, binaryClient, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, legacyClient, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	//every byte value has to survive both the raw binary and the legacy signed number encodings
+	request := make(internal.BurpBytes, 256)
+	for i := range request {
+		request[i] = byte(i)
+	}
+	message := &internal.BurpTCMessage{
+		MessageType: "BURP_MESSAGE",
+		BurpRequestResponse: &internal.BurpRequestResponse{
+			Request:     request,
+			Response:    internal.BurpBytes("HTTP/1.1 200 OK\r\n\r\n\x00\xff"),
+			HttpService: &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"},
+		},
+	}
+	for _, clients := range [][2]*websocket.Conn{{binaryClient, legacyClient}, {legacyClient, binaryClient}} {
+		if err := sendBurpTCMessage(clients[0], message); err != nil {
+			t.Fatal(err)
+		}
+		received := awaitBurpTCMessage(t, clients[1], "BURP_MESSAGE")
+		if !bytes.Equal(received.BurpRequestResponse.Request, message.BurpRequestResponse.Request) ||
+			!bytes.Equal(received.BurpRequestResponse.Response, message.BurpRequestResponse.Response) {
+			t.Fatalf("bytes changed on the way to the %q client: %v", clients[1].Subprotocol(), received.BurpRequestResponse)
+		}
+	}
+}
+
+func TestCompressionSavesBytes(t *testing.T) {
+	wsDialer := startTestServer(t)
+	wsDialer.EnableCompression = true
+	roomName := "deflate" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	sendAndAwait(t, clients[0], &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, clients[1], &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	message := &internal.BurpTCMessage{
+		MessageType: "BURP_MESSAGE",
+		BurpRequestResponse: &internal.BurpRequestResponse{
+			Request:     internal.BurpBytes("GET / HTTP/1.1\r\n\r\n"),
+			Response:    internal.BurpBytes(strings.Repeat("<div class=\"row\">Burp</div>", 1000)),
+			HttpService: &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"},
+		},
+	}
+	if err := sendBurpTCMessage(clients[0], message); err != nil {
+		t.Fatal(err)
+	}
+	awaitBurpTCMessage(t, clients[1], "BURP_MESSAGE")
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: wsDialer.TLSClientConfig}}
+	statsRequest, _ := http.NewRequest("GET", fmt.Sprintf("https://%s:%s/stats", testHost, testPort), nil)
+	statsRequest.Header.Set("Username", randSeq(10))
+	response, err := httpClient.Do(statsRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	stats := &internal.ServerStats{}
+	if err := json.NewDecoder(response.Body).Decode(stats); err != nil {
+		t.Fatal(err)
+	}
+	roomStats, ok := stats.Rooms[roomName]
+	if !ok {
+		t.Fatalf("no stats for room %s", roomName)
+	}
+	if roomStats.BytesSaved <= 0 || roomStats.WireBytes >= roomStats.MessageBytes {
+		t.Fatalf("compression saved nothing: %+v", roomStats)
+	}
+}
+
+func TestShortenerOverTLS(t *testing.T) {
+	wsDialer := startTestServer(t)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "GET_CONFIG_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	apiKey := awaitBurpTCMessage(t, ws, "GET_CONFIG_MESSAGE").Data
+
+	shared := &internal.BurpRequestResponse{
+		Request:     internal.BurpBytes("GET /secret HTTP/1.1\r\nCookie: session=1\r\n\r\n"),
+		HttpService: &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"},
+	}
+	sharedJson, _ := json.Marshal(shared)
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: wsDialer.TLSClientConfig}}
+	response, err := httpClient.Post(fmt.Sprintf("https://%s:%s/shortener?key=%s", testHost, testPort, apiKey), "application/json", bytes.NewReader(sharedJson))
+	if err != nil {
+		t.Fatal(err)
+	}
+	encodedURL, _ := ioutil.ReadAll(response.Body)
+	_ = response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		t.Fatalf("shortening failed with %d: %s", response.StatusCode, encodedURL)
+	}
+	accessURL, err := base64.StdEncoding.DecodeString(string(encodedURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedPrefix := fmt.Sprintf("https://%s:%s/shortener?id=", testHost, testPort)
+	if !strings.HasPrefix(string(accessURL), expectedPrefix) {
+		t.Fatalf("shortened url %s does not start with %s", accessURL, expectedPrefix)
+	}
+
+	response, err = httpClient.Get(string(accessURL))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	fetched := &internal.BurpRequestResponse{}
+	if err := json.NewDecoder(response.Body).Decode(fetched); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(fetched.Request, shared.Request) {
+		t.Fatalf("fetched request %q, expected %q", fetched.Request, shared.Request)
+	}
+
+	viewRequest, _ := http.NewRequest("GET", string(accessURL), nil)
+	viewRequest.Header.Set("Accept", "text/html,application/xhtml+xml,*/*;q=0.8")
+	response, err = httpClient.Do(viewRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+	page, _ := ioutil.ReadAll(response.Body)
+	if !strings.HasPrefix(response.Header.Get("Content-Type"), "text/html") {
+		t.Fatalf("browsers were sent %s instead of HTML", response.Header.Get("Content-Type"))
+	}
+	for _, expected := range []string{"GET /secret HTTP/1.1", "curl -X", "https://example.com/secret"} {
+		if !strings.Contains(string(page), expected) {
+			t.Errorf("view page is missing %q", expected)
+		}
+	}
+}
+
+func TestShortenerApiKeyRotation(t *testing.T) {
+	wsDialer := startTestServer(t)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	getApiKey := func() string {
+		if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "GET_CONFIG_MESSAGE"}); err != nil {
+			t.Fatal(err)
+		}
+		return awaitBurpTCMessage(t, ws, "GET_CONFIG_MESSAGE").Data
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: wsDialer.TLSClientConfig}}
+	shortenWith := func(apiKey string) int {
+		response, err := httpClient.Post(fmt.Sprintf("https://%s:%s/shortener?key=%s", testHost, testPort, apiKey), "application/json", strings.NewReader(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		return response.StatusCode
+	}
+	oldKey := getApiKey()
+
+	//rotating the key file takes effect without restarting the server
+	newKey, err := internal.RotateShortenerApiKey(filepath.Join(testDataDir, internal.ShortenerKeyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if apiKey := getApiKey(); apiKey != newKey {
+		t.Fatalf("clients were given %q after rotating to %q", apiKey, newKey)
+	}
+	if status := shortenWith(newKey); status != http.StatusOK {
+		t.Fatalf("the new key was refused with %d", status)
+	}
+	if status := shortenWith(oldKey); status == http.StatusOK {
+		t.Fatal("the old key still works after rotating")
+	}
+}
+
+func TestShortenerLinkManagement(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "links" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 3; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	owner, member, outsider := clients[0], clients[1], clients[2]
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, member, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	sendAndAwait(t, outsider, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: "other" + roomName}, "NEW_MEMBER_MESSAGE")
+
+	shorten := func(ws *websocket.Conn) string {
+		if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{
+			MessageType: "SHORTEN_LINK_MESSAGE",
+			Data:        `{"ttl":"1h"}`,
+			BurpRequestResponse: &internal.BurpRequestResponse{
+				Request:     internal.BurpBytes("GET /token HTTP/1.1\r\n\r\n"),
+				HttpService: &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return awaitBurpTCMessage(t, ws, "SHORTEN_LINK_MESSAGE").Data
+	}
+	getLinks := func(ws *websocket.Conn, data string) map[string]*internal.LinkInfo {
+		if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "GET_LINKS_MESSAGE", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		var links []*internal.LinkInfo
+		if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, ws, "GET_LINKS_MESSAGE").Data), &links); err != nil {
+			t.Fatal(err)
+		}
+		linksByRoomAndURL := make(map[string]*internal.LinkInfo)
+		for _, link := range links {
+			linksByRoomAndURL[link.Room+" "+link.URL] = link
+		}
+		return linksByRoomAndURL
+	}
+	awaitError := func(ws *websocket.Conn, message *internal.BurpTCMessage) string {
+		if err := sendBurpTCMessage(ws, message); err != nil {
+			t.Fatal(err)
+		}
+		clientError := &internal.ClientError{}
+		if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, ws, "ERROR_MESSAGE").Data), clientError); err != nil {
+			t.Fatal(err)
+		}
+		return clientError.Code
+	}
+	ownerURL := shorten(owner)
+	memberURL := shorten(member)
+
+	links := getLinks(owner, roomName)
+	ownerLink, memberLink := links[roomName+" "+ownerURL], links[roomName+" "]
+	if len(links) != 2 || ownerLink == nil || memberLink == nil || len(ownerLink.Creator) == 0 {
+		t.Fatalf("expected both links shared from %s with only the owner's url, got %+v", roomName, links)
+	}
+	//members see the room's links too, but only get the urls of their own
+	if links := getLinks(member, ""); links[roomName+" "+memberURL] == nil || links[roomName+" "] == nil {
+		t.Fatalf("member got %+v", links)
+	}
+	if links := getLinks(outsider, ""); len(links) != 0 {
+		t.Fatalf("a client outside the room got its links: %+v", links)
+	}
+	for _, messageType := range []string{"GET_LINK_MESSAGE", "REVOKE_LINK_MESSAGE"} {
+		if code := awaitError(outsider, &internal.BurpTCMessage{MessageType: messageType, Data: ownerLink.Id}); code != internal.ErrorLinkNotFound {
+			t.Errorf("%s from outside the room got %s", messageType, code)
+		}
+	}
+	if code := awaitError(member, &internal.BurpTCMessage{MessageType: "REVOKE_LINK_MESSAGE", Data: ownerLink.Id}); code != internal.ErrorPermissionDenied {
+		t.Errorf("a member revoking someone else's link got %s", code)
+	}
+	//owners can revoke any link shared from their room
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "REVOKE_LINK_MESSAGE", Data: memberLink.Id}, "REVOKE_LINK_MESSAGE")
+
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "REVOKE_LINK_MESSAGE", Data: ownerLink.Id}, "REVOKE_LINK_MESSAGE")
+	if code := awaitError(owner, &internal.BurpTCMessage{MessageType: "GET_LINK_MESSAGE", Data: ownerLink.Id}); code != internal.ErrorLinkNotFound {
+		t.Fatalf("expected %s for a revoked link, got %s", internal.ErrorLinkNotFound, code)
+	}
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: wsDialer.TLSClientConfig}}
+	for _, accessURL := range []string{ownerURL, memberURL} {
+		response, err := httpClient.Get(accessURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		if response.StatusCode == http.StatusOK {
+			t.Fatal("revoked link can still be viewed")
+		}
+	}
+
+	//only the admin key manages every link over HTTP, the API key clients are given doesn't
+	oldURL := shorten(owner)
+	listLinks := func(key string) (int, []*internal.LinkInfo) {
+		response, err := httpClient.Get(fmt.Sprintf("https://%s:%s%s?key=%s", testHost, testPort, internal.ShortenerLinksPath, key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+		var links []*internal.LinkInfo
+		if response.StatusCode == http.StatusOK {
+			if err := json.NewDecoder(response.Body).Decode(&links); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return response.StatusCode, links
+	}
+	if err := sendBurpTCMessage(member, &internal.BurpTCMessage{MessageType: "GET_CONFIG_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	if status, _ := listLinks(awaitBurpTCMessage(t, member, "GET_CONFIG_MESSAGE").Data); status != http.StatusUnauthorized {
+		t.Fatalf("listing links with the API key got %d", status)
+	}
+	adminKey, err := ioutil.ReadFile(filepath.Join(testDataDir, internal.ShortenerAdminKeyFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	status, allLinks := listLinks(string(adminKey))
+	listed := false
+	for _, link := range allLinks {
+		listed = listed || link.URL == oldURL
+	}
+	if status != http.StatusOK || !listed {
+		t.Fatalf("listing links with the admin key got %d without %s", status, oldURL)
+	}
+
+	//a later room with the same name doesn't get the old room's links
+	if err := sendBurpTCMessage(owner, &internal.BurpTCMessage{MessageType: "DELETE_ROOM_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "GET_ROOMS_MESSAGE"}, "GET_ROOMS_MESSAGE")
+	sendAndAwait(t, outsider, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	if links := getLinks(outsider, roomName); len(links) != 0 {
+		t.Fatalf("a new room got the links of an old room with the same name: %+v", links)
+	}
+	for _, link := range allLinks {
+		if link.URL == oldURL {
+			if code := awaitError(outsider, &internal.BurpTCMessage{MessageType: "REVOKE_LINK_MESSAGE", Data: link.Id}); code != internal.ErrorLinkNotFound {
+				t.Fatalf("the owner of a new room with the same name revoking an old link got %s", code)
+			}
+		}
+	}
+}
+
+func TestLinkLifetimes(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "lifetimes" + randSeq(6)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	sendAndAwait(t, ws, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+
+	//share a response so links can refer to it by hash
+	response := internal.BurpBytes("HTTP/1.1 200 OK\r\n\r\n" + randSeq(50))
+	if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{
+		MessageType:         "BURP_MESSAGE",
+		BurpRequestResponse: &internal.BurpRequestResponse{Request: internal.BurpBytes("GET / HTTP/1.1\r\n\r\n"), Response: response},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	sendAndAwait(t, ws, &internal.BurpTCMessage{MessageType: "GET_SCOPE_MESSAGE"}, "GET_SCOPE_MESSAGE")
+	responseHash := sha256.Sum256(response)
+	shorten := func(data string) string {
+		if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{
+			MessageType: "SHORTEN_LINK_MESSAGE",
+			Data:        data,
+			BurpRequestResponse: &internal.BurpRequestResponse{
+				Request:      internal.BurpBytes("GET / HTTP/1.1\r\n\r\n"),
+				ResponseHash: hex.EncodeToString(responseHash[:]),
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return awaitBurpTCMessage(t, ws, "SHORTEN_LINK_MESSAGE").Data
+	}
+	burnURL := shorten(`{"burn":true}`)
+	twoViewURL := shorten(`{"maxViews":2}`)
+
+	//links keep their own copy of the bodies, so they outlive the room they were shared from
+	if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "DELETE_ROOM_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	sendAndAwait(t, ws, &internal.BurpTCMessage{MessageType: "GET_ROOMS_MESSAGE"}, "GET_ROOMS_MESSAGE")
+
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: wsDialer.TLSClientConfig}}
+	view := func(accessURL string) (int, []byte) {
+		viewed, err := httpClient.Get(accessURL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer viewed.Body.Close()
+		body, _ := ioutil.ReadAll(viewed.Body)
+		return viewed.StatusCode, body
+	}
+	for _, test := range []struct {
+		accessURL string
+		views     int
+	}{
+		{burnURL, 1},
+		{twoViewURL, 2},
+	} {
+		for i := 0; i < test.views; i++ {
+			status, body := view(test.accessURL)
+			if status != http.StatusOK {
+				t.Fatalf("view %d of %s failed with %d", i+1, test.accessURL, status)
+			}
+			fetched := &internal.BurpRequestResponse{}
+			if err := json.Unmarshal(body, fetched); err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(fetched.Response, response) || len(fetched.RequestHash) > 0 || len(fetched.ResponseHash) > 0 {
+				t.Fatalf("link was served as %s", body)
+			}
+		}
+		if status, _ := view(test.accessURL); status == http.StatusOK {
+			t.Errorf("%s could be viewed more than %d times", test.accessURL, test.views)
+		}
+	}
+}
+
+func TestLinkStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "links.db")
+	links, err := internal.NewLinkStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	for _, link := range []*internal.ShortenedLink{
+		{Id: "expired", Expires: now.Add(-time.Minute)},
+		{Id: "expiring", Expires: now.Add(time.Hour)},
+		{Id: "twoViews", MaxViews: 2},
+		{Id: "burn", BurnAfterReading: true},
+		{Id: "forever"},
+	} {
+		link.Request = &internal.BurpRequestResponse{Request: internal.BurpBytes("GET /" + link.Id)}
+		link.Created = now
+		if err := links.CreateLink(link); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := links.CreateLink(&internal.ShortenedLink{Id: "forever", Request: &internal.BurpRequestResponse{}}); err == nil {
+		t.Fatal("a link replaced another with the same id")
+	}
+	viewed := func(id string) bool {
+		link, err := links.ViewLink(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return link != nil && string(link.Request.Request) == "GET /"+id
+	}
+	if viewed("expired") {
+		t.Error("an expired link was viewed")
+	}
+	if !viewed("burn") || viewed("burn") {
+		t.Error("a burn after reading link wasn't viewable exactly once")
+	}
+	if !viewed("twoViews") {
+		t.Error("a link couldn't be viewed")
+	}
+
+	//views and links survive a restart
+	if err := links.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if links, err = internal.NewLinkStore(path); err != nil {
+		t.Fatal(err)
+	}
+	defer links.Close()
+	if !viewed("twoViews") || viewed("twoViews") {
+		t.Error("a link with two views wasn't viewable exactly twice across a restart")
+	}
+
+	//the reaper only deletes links that have expired by the time it runs
+	if reaped, err := links.ReapExpired(now.Add(2 * time.Hour)); err != nil || reaped != 1 {
+		t.Fatalf("reaped %d links: %v", reaped, err)
+	}
+	remaining, err := links.ListLinks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(remaining) != 1 || remaining[0].Id != "forever" {
+		t.Fatalf("links left after reaping: %+v", remaining)
+	}
+}
+
+func TestRedaction(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "redact" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	sendAndAwait(t, clients[0], &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, clients[1], &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	rules := `{"headers": ["Authorization"], "cookies": ["session"], "patterns": ["token=(\\w+)"]}`
+	sendAndAwait(t, clients[0], &internal.BurpTCMessage{MessageType: "SET_REDACTION_MESSAGE", Data: rules}, "SET_REDACTION_MESSAGE")
+
+	request := "POST /login HTTP/1.1\r\nAuthorization: Bearer secret\r\nCookie: theme=dark; session=secret\r\n\r\ntoken=secret&user=bob"
+	redactedRequest := "POST /login HTTP/1.1\r\nAuthorization: [REDACTED]\r\nCookie: theme=dark; session=[REDACTED]\r\n\r\ntoken=[REDACTED]&user=bob"
+	for _, test := range []struct {
+		messageType string
+		noRedact    bool
+		expected    string
+	}{
+		{"BURP_MESSAGE", false, redactedRequest},
+		//only cookie messages can opt out
+		{"REPEATER_MESSAGE", true, redactedRequest},
+		{"COOKIE_MESSAGE", true, request},
+	} {
+		if err := sendBurpTCMessage(clients[0], &internal.BurpTCMessage{
+			MessageType: test.messageType,
+			NoRedact:    test.noRedact,
+			BurpRequestResponse: &internal.BurpRequestResponse{
+				Request:     internal.BurpBytes(request),
+				HttpService: &internal.BurpMetaData{Host: "example.com", Port: 443, Protocol: "https"},
+			},
+		}); err != nil {
+			t.Fatal(err)
+		}
+		received := awaitBurpTCMessage(t, clients[1], test.messageType)
+		if string(received.BurpRequestResponse.Request) != test.expected {
+			t.Errorf("%s was shared as %q, expected %q", test.messageType, received.BurpRequestResponse.Request, test.expected)
+		}
+	}
+}
+
+func TestClientCertificates(t *testing.T) {
+	wsDialer := startTestServer(t)
+	username := "cert" + randSeq(6)
+	clientCerts, err := internal.LoadClientCertStore(filepath.Join(testDataDir, internal.ClientCertsFileName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, certPEM, keyPEM, err := clientCerts.Issue(internal.ServerCertFile, internal.ServerKeyFile, username, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientCert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		t.Fatal(err)
+	}
+	wsDialer.TLSClientConfig = &tls.Config{
+		Certificates: []tls.Certificate{clientCert},
+		RootCAs:      wsDialer.TLSClientConfig.RootCAs,
+	}
+
+	if _, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {"someoneElse"}}); err == nil {
+		t.Fatal("a client certificate let its holder connect as another user")
+	}
+	//no password is needed when the certificate says who the client is
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	//the certificate vouches for the owner of a persistent room
+	persistentRoom, _ := json.Marshal(&internal.RoomRequest{Name: "certs" + randSeq(6), Options: internal.RoomOptions{Persistent: true}})
+	sendAndAwait(t, ws, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: string(persistentRoom)}, "NEW_MEMBER_MESSAGE")
+	if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "GET_ROLES_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	roles := map[string]string{}
+	if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, ws, "ROLES_MESSAGE").Data), &roles); err != nil {
+		t.Fatal(err)
+	}
+	for clientName := range roles {
+		if !strings.HasPrefix(clientName, username+"#") {
+			t.Errorf("client connected as %s instead of the certificate's %s", clientName, username)
+		}
+	}
+	ws.Close()
+
+	if revoked, err := clientCerts.Revoke(username, ""); err != nil || revoked != 1 {
+		t.Fatalf("revoked %d certificates: %v", revoked, err)
+	}
+	if ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), nil); err == nil {
+		ws.Close()
+		t.Fatal("a revoked certificate was accepted")
+	}
+}
+
+func TestCertificateRotation(t *testing.T) {
+	wsDialer := startTestServer(t)
+	connected, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer connected.Close()
+	oldCert := connected.UnderlyingConn().(*tls.Conn).ConnectionState().PeerCertificates[0]
+
+	renewed, err := internal.RotateCert("", internal.ServerCertFile, internal.ServerKeyFile, 400*24*time.Hour, false, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	//trust the renewed certificate like a client handed the new file would
+	wsDialer = startTestServer(t)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	newCert := ws.UnderlyingConn().(*tls.Conn).ConnectionState().PeerCertificates[0]
+	if newCert.SerialNumber.Cmp(renewed.SerialNumber) != 0 || newCert.SerialNumber.Cmp(oldCert.SerialNumber) == 0 {
+		t.Fatalf("server still presents certificate %s after renewing to %s", newCert.SerialNumber.Text(16), renewed.SerialNumber.Text(16))
+	}
+	sendAndAwait(t, connected, &internal.BurpTCMessage{MessageType: "GET_ROOMS_MESSAGE"}, "GET_ROOMS_MESSAGE")
+}
+
+func TestTLSConfiguration(t *testing.T) {
+	wsDialer := startTestServer(t)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	if version := ws.UnderlyingConn().(*tls.Conn).ConnectionState().Version; version != tls.VersionTLS13 {
+		t.Fatalf("negotiated TLS version %x instead of 1.3", version)
+	}
+
+	if version, err := internal.ParseTLSVersion("1.2"); err != nil || version != tls.VersionTLS12 {
+		t.Fatalf("1.2 parsed as %x: %v", version, err)
+	}
+	if _, err := internal.ParseTLSVersion("1.4"); err == nil {
+		t.Fatal("parsed an unknown TLS version")
+	}
+	suites, err := internal.ParseCipherSuites("TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256, TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384")
+	if err != nil || len(suites) != 2 || suites[0] != tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256 {
+		t.Fatalf("cipher suites parsed as %v: %v", suites, err)
+	}
+	for _, suite := range []string{"TLS_AES_128_GCM_SHA256", "TLS_RSA_WITH_RC4_128_SHA", "TLS_MADE_UP"} {
+		if _, err := internal.ParseCipherSuites(suite); err == nil {
+			t.Fatalf("accepted cipher suite %s", suite)
+		}
+	}
+
+	//a P-256 key is generated on request, and kept when the certificate is renewed
+	certFile, keyFile := filepath.Join(t.TempDir(), "server.pem"), filepath.Join(t.TempDir(), "server.key")
+	internal.GenCrt(testHost, certFile, keyFile, internal.KeyTypeECDSA)
+	renewed, err := internal.RotateCert("", certFile, keyFile, 24*time.Hour, true, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.PublicKeyAlgorithm != x509.ECDSA {
+		t.Fatalf("renewed certificate has a %s key", renewed.PublicKeyAlgorithm)
+	}
+	if fingerprint := internal.CertFingerprint(renewed); len(fingerprint) != 95 || strings.ToUpper(fingerprint) != fingerprint {
+		t.Fatalf("unexpected fingerprint format %s", fingerprint)
+	}
+}
+
+func TestRoomHistory(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "history" + randSeq(6)
+	username := randSeq(10)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {username}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sendAndAwait(t, ws, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	for i := 0; i < 3; i++ {
+		if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{
+			MessageType:         "BURP_MESSAGE",
+			BurpRequestResponse: &internal.BurpRequestResponse{Request: internal.BurpBytes(fmt.Sprintf("GET /%d HTTP/1.1\r\n\r\n", i))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	historyPage := func(ws *websocket.Conn, data string) *internal.HistoryPage {
+		if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "GET_HISTORY_MESSAGE", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		page := &internal.HistoryPage{}
+		if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, ws, "HISTORY_MESSAGE").Data), page); err != nil {
+			t.Fatal(err)
+		}
+		return page
+	}
+	if page := historyPage(ws, "0:2"); page.Total != 3 || len(page.Entries) != 2 || page.Entries[1].Sequence != 1 {
+		t.Fatalf("unexpected first page %+v", page)
+	}
+	page := historyPage(ws, "2")
+	if page.Total != 3 || len(page.Entries) != 1 || page.Entries[0].Sequence != 2 {
+		t.Fatalf("unexpected last page %+v", page)
+	}
+	if request := string(page.Entries[0].Message.BurpRequestResponse.Request); request != "GET /2 HTTP/1.1\r\n\r\n" {
+		t.Fatalf("replayed %q", request)
+	}
+
+	//the room and its history outlive its only member losing their connection
+	_ = ws.Close()
+	ws, _, err = wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {username}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	sendAndAwait(t, ws, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	if page := historyPage(ws, "0"); page.Total != 3 {
+		t.Fatalf("rejoining member got %d history entries instead of 3", page.Total)
+	}
+}
+
+func TestStaleHistoryRemovedOnStartup(t *testing.T) {
+	dataDir, err := ioutil.TempDir("", "BurpSuiteTeamServer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	history, err := internal.NewHistoryStore(filepath.Join(dataDir, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := history.Append("stale", "someone", &internal.BurpTCMessage{MessageType: "BURP_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	internal.NewHub("", history, nil, nil)
+	page, err := history.Page("stale", 0, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if page.Total != 0 {
+		t.Fatalf("a new room would inherit %d history entries from an earlier run", page.Total)
+	}
+}
+
+func TestRoomPasswordsAndPersistence(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "locked" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	owner, joiner := clients[0], clients[1]
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName + ":secret"}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, joiner, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName + ":wrong"}, "BAD_PASSWORD_MESSAGE")
+	sendAndAwait(t, joiner, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName + ":secret"}, "GOOD_PASSWORD_MESSAGE")
+
+	//anyone can claim a username with the shared password, so it can't own a room that outlives the connection
+	persistentRoom, _ := json.Marshal(&internal.RoomRequest{Name: "kept" + randSeq(6), Options: internal.RoomOptions{Persistent: true}})
+	sendAndAwait(t, joiner, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: string(persistentRoom)}, "ERROR_MESSAGE")
+
+	//persistent rooms and their history are restored by the next run, everything else is gone
+	dataDir := t.TempDir()
+	roomStore, err := internal.NewRoomStore(filepath.Join(dataDir, "rooms.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	kept, err := internal.NewRoom("kept", "secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := roomStore.SaveRoom(kept); err != nil {
+		t.Fatal(err)
+	}
+	if err := roomStore.Close(); err != nil {
+		t.Fatal(err)
+	}
+	history, err := internal.NewHistoryStore(filepath.Join(dataDir, "history"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, roomName := range []string{"kept", "gone"} {
+		if err := history.Append(roomName, "someone", &internal.BurpTCMessage{MessageType: "BURP_MESSAGE"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if roomStore, err = internal.NewRoomStore(filepath.Join(dataDir, "rooms.db")); err != nil {
+		t.Fatal(err)
+	}
+	defer roomStore.Close()
+	restarted := internal.NewHub("", history, roomStore, nil)
+	if _, ok := restarted.RoomStats()["kept"]; !ok {
+		t.Fatalf("persistent room was not restored, found %v", restarted.RoomStats())
+	}
+	for roomName, total := range map[string]int{"kept": 1, "gone": 0} {
+		if page, err := history.Page(roomName, 0, 10); err != nil || page.Total != total {
+			t.Fatalf("room %s has %+v history after restarting instead of %d entries: %v", roomName, page, total, err)
+		}
+	}
+}
+
+func TestComments(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "comments" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	author, other := clients[0], clients[1]
+	sendAndAwait(t, author, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, other, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	request := func(host string) *internal.BurpRequestResponse {
+		return &internal.BurpRequestResponse{
+			Request:     internal.BurpBytes("GET /comments HTTP/1.1\r\n\r\n"),
+			HttpService: &internal.BurpMetaData{Host: host, Port: 443, Protocol: "https"},
+		}
+	}
+	//every member sees the comments on a request change
+	commentsChange := func(msg *internal.BurpTCMessage) []internal.Comment {
+		if err := sendBurpTCMessage(author, msg); err != nil {
+			t.Fatal(err)
+		}
+		awaitBurpTCMessage(t, other, "COMMENTS_MESSAGE")
+		return awaitBurpTCMessage(t, author, "COMMENTS_MESSAGE").BurpRequestResponse.Comments
+	}
+	comments := commentsChange(&internal.BurpTCMessage{MessageType: "ADD_COMMENT_MESSAGE", Data: "first", BurpRequestResponse: request("example.com")})
+	if len(comments) != 1 || comments[0].Comment != "first" {
+		t.Fatalf("unexpected comments %+v", comments)
+	}
+	commentId := comments[0].Id
+
+	sendAndAwait(t, other, &internal.BurpTCMessage{MessageType: "EDIT_COMMENT_MESSAGE", Data: commentId + ":hijacked", BurpRequestResponse: request("example.com")}, "ERROR_MESSAGE")
+	sendAndAwait(t, other, &internal.BurpTCMessage{MessageType: "DELETE_COMMENT_MESSAGE", Data: commentId, BurpRequestResponse: request("example.com")}, "ERROR_MESSAGE")
+	if comments := commentsChange(&internal.BurpTCMessage{MessageType: "EDIT_COMMENT_MESSAGE", Data: commentId + ":edited: with a colon", BurpRequestResponse: request("example.com")}); len(comments) != 1 || comments[0].Comment != "edited: with a colon" {
+		t.Fatalf("unexpected comments after editing %+v", comments)
+	}
+
+	getComments := func(burpRequestResponse *internal.BurpRequestResponse) []internal.Comment {
+		if err := sendBurpTCMessage(other, &internal.BurpTCMessage{MessageType: "GET_COMMENTS_MESSAGE", BurpRequestResponse: burpRequestResponse}); err != nil {
+			t.Fatal(err)
+		}
+		return awaitBurpTCMessage(t, other, "COMMENTS_MESSAGE").BurpRequestResponse.Comments
+	}
+	if comments := getComments(request("example.com")); len(comments) != 1 || comments[0].Comment != "edited: with a colon" {
+		t.Fatalf("fetched comments %+v", comments)
+	}
+	//the same request sent to another host is a different request
+	if comments := getComments(request("example.org")); len(comments) != 0 {
+		t.Fatalf("comments leaked to another host %+v", comments)
+	}
+
+	if comments := commentsChange(&internal.BurpTCMessage{MessageType: "DELETE_COMMENT_MESSAGE", Data: commentId, BurpRequestResponse: request("example.com")}); len(comments) != 0 {
+		t.Fatalf("comment survived deleting %+v", comments)
+	}
+	if err := sendBurpTCMessage(other, &internal.BurpTCMessage{MessageType: "GET_COMMENTS_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	if allComments := awaitBurpTCMessage(t, other, "ALL_COMMENTS_MESSAGE").Data; allComments != "[]" {
+		t.Fatalf("room still has comments %s", allComments)
+	}
+
+	//requests are shown to the room redacted, but their comments are found from the request as it was sent
+	secretRequest := request("example.com")
+	secretRequest.Request = internal.BurpBytes("GET /comments HTTP/1.1\r\nAuthorization: Bearer secret\r\n\r\n")
+	if err := sendBurpTCMessage(author, &internal.BurpTCMessage{MessageType: "ADD_COMMENT_MESSAGE", Data: "secret", BurpRequestResponse: secretRequest}); err != nil {
+		t.Fatal(err)
+	}
+	if shown := awaitBurpTCMessage(t, other, "COMMENTS_MESSAGE").BurpRequestResponse; strings.Contains(string(shown.Request), "Bearer secret") {
+		t.Fatalf("commented request was shown unredacted: %q", shown.Request)
+	}
+	sendAndAwait(t, author, &internal.BurpTCMessage{MessageType: "SET_REDACTION_MESSAGE", Data: `{"headers": ["Cookie"]}`}, "SET_REDACTION_MESSAGE")
+	if comments := getComments(secretRequest); len(comments) != 1 || comments[0].Comment != "secret" {
+		t.Fatalf("changing the redaction rules lost the comments: %+v", comments)
+	}
+}
+
+func TestUserStoreReload(t *testing.T) {
+	usersFile := filepath.Join(t.TempDir(), internal.UsersFileName)
+	server, err := internal.LoadUserStore(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if server.HasUsers() {
+		t.Fatal("a new user list has users")
+	}
+	if err := server.AddUser("alice", "first"); err != nil {
+		t.Fatal(err)
+	}
+	if err := server.AddUser("alice", "again"); err == nil {
+		t.Fatal("added the same user twice")
+	}
+	if err := server.AddUser("bad:name", "password"); err == nil {
+		t.Fatal("added a user whose name can't be told apart from a client name")
+	}
+	if !server.Authenticate("alice", "first") || server.Authenticate("alice", "wrong") || server.Authenticate("bob", "first") {
+		t.Fatal("authenticated the wrong users")
+	}
+
+	//the command line changes the file under the running server
+	commandLine, err := internal.LoadUserStore(usersFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := commandLine.ResetPassword("alice", "second"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Authenticate("alice", "first") || !server.Authenticate("alice", "second") {
+		t.Fatal("the server did not pick up the reset password")
+	}
+	if changed, err := server.Reload(); err != nil || len(changed) != 1 || changed[0] != "alice" {
+		t.Fatalf("reset users %v: %v", changed, err)
+	}
+	if err := commandLine.RemoveUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := server.Reload(); err != nil || len(changed) != 1 || changed[0] != "alice" {
+		t.Fatalf("removed users %v: %v", changed, err)
+	}
+	if server.Authenticate("alice", "second") || server.HasUsers() {
+		t.Fatal("a removed user can still log in")
+	}
+	if changed, err := server.Reload(); err != nil || len(changed) != 0 {
+		t.Fatalf("users reported as changed twice %v: %v", changed, err)
+	}
+}
+
+func TestRoles(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "roles" + randSeq(6)
+	clients := map[string]*websocket.Conn{}
+	usernames := map[string]string{}
+	for _, role := range []string{"owner", "member", "observer"} {
+		usernames[role] = role + randSeq(6)
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {usernames[role]}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients[role] = ws
+	}
+	sendAndAwait(t, clients["owner"], &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, clients["member"], &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	observe, _ := json.Marshal(&internal.RoomRequest{Name: roomName, Options: internal.RoomOptions{Observer: true}})
+	sendAndAwait(t, clients["observer"], &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: string(observe)}, "ROLES_MESSAGE")
+	clientNames := awaitRoles(t, clients["owner"], map[string]string{usernames["owner"]: "owner", usernames["member"]: "member", usernames["observer"]: "observer"})
+
+	sendAndAwait(t, clients["observer"], &internal.BurpTCMessage{MessageType: "BURP_MESSAGE", BurpRequestResponse: &internal.BurpRequestResponse{}}, "ERROR_MESSAGE")
+	sendAndAwait(t, clients["member"], &internal.BurpTCMessage{MessageType: "DEMOTE_MESSAGE", Data: clientNames[usernames["observer"]]}, "ERROR_MESSAGE")
+	if err := sendBurpTCMessage(clients["owner"], &internal.BurpTCMessage{MessageType: "PROMOTE_MESSAGE", Data: clientNames[usernames["member"]]}); err != nil {
+		t.Fatal(err)
+	}
+	awaitRoles(t, clients["member"], map[string]string{usernames["member"]: "owner"})
+	if err := sendBurpTCMessage(clients["owner"], &internal.BurpTCMessage{MessageType: "DEMOTE_MESSAGE", Data: clientNames[usernames["member"]]}); err != nil {
+		t.Fatal(err)
+	}
+	awaitRoles(t, clients["member"], map[string]string{usernames["member"]: "member"})
+
+	//observing only lasted while the observer was in the room
+	if err := sendBurpTCMessage(clients["observer"], &internal.BurpTCMessage{MessageType: "LEAVE_ROOM_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	sendAndAwait(t, clients["observer"], &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	awaitRoles(t, clients["owner"], map[string]string{usernames["observer"]: "member"})
+}
+
+func TestKickAndBan(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "bans" + randSeq(6)
+	ownerName, targetName := "owner"+randSeq(6), "target"+randSeq(6)
+	owner, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {ownerName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer owner.Close()
+	target, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {targetName}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, target, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	clientNames := awaitRoles(t, owner, map[string]string{ownerName: "owner", targetName: "member"})
+
+	sendAndAwait(t, target, &internal.BurpTCMessage{MessageType: "KICK_MESSAGE", Data: clientNames[ownerName]}, "ERROR_MESSAGE")
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "BAN_MESSAGE", Data: clientNames[ownerName]}, "ERROR_MESSAGE")
+	sendAndAwait(t, owner, &internal.BurpTCMessage{MessageType: "KICK_MESSAGE", Data: "nobody#1"}, "ERROR_MESSAGE")
+
+	//a kicked user can come straight back
+	if err := sendBurpTCMessage(owner, &internal.BurpTCMessage{MessageType: "KICK_MESSAGE", Data: clientNames[targetName]}); err != nil {
+		t.Fatal(err)
+	}
+	if kicked := awaitBurpTCMessage(t, target, "KICKED_MESSAGE"); kicked.Data != roomName {
+		t.Fatalf("kicked from %s instead of %s", kicked.Data, roomName)
+	}
+	sendAndAwait(t, target, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	//a banned one can't until they are unbanned
+	clientNames = awaitRoles(t, owner, map[string]string{targetName: "member"})
+	if err := sendBurpTCMessage(owner, &internal.BurpTCMessage{MessageType: "BAN_MESSAGE", Data: clientNames[targetName]}); err != nil {
+		t.Fatal(err)
+	}
+	awaitBurpTCMessage(t, target, "KICKED_MESSAGE")
+	sendAndAwait(t, target, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ERROR_MESSAGE")
+
+	//nobody runs the lobby, so owner commands are refused there
+	for _, message := range []*internal.BurpTCMessage{
+		{MessageType: "SET_REDACTION_MESSAGE", Data: "{}"},
+		{MessageType: "BAN_MESSAGE", Data: clientNames[ownerName]},
+		{MessageType: "KICK_MESSAGE", Data: clientNames[ownerName]},
+	} {
+		if err := sendBurpTCMessage(target, message); err != nil {
+			t.Fatal(err)
+		}
+		if reply := awaitBurpTCMessage(t, target, "ERROR_MESSAGE"); !strings.Contains(reply.Data, internal.ErrorPermissionDenied) {
+			t.Errorf("%s in the lobby got %s", message.MessageType, reply.Data)
+		}
+	}
+
+	//unbanning takes the client name the ban was given with, and refuses users who aren't banned
+	if err := sendBurpTCMessage(owner, &internal.BurpTCMessage{MessageType: "UNBAN_MESSAGE", Data: clientNames[targetName]}); err != nil {
+		t.Fatal(err)
+	}
+	if err := sendBurpTCMessage(owner, &internal.BurpTCMessage{MessageType: "UNBAN_MESSAGE", Data: targetName}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := awaitBurpTCMessage(t, owner, "ERROR_MESSAGE"); !strings.Contains(reply.Data, internal.ErrorBadPayload) {
+		t.Fatalf("unbanning a user twice got %s", reply.Data)
+	}
+	sendAndAwait(t, target, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+}
+
+func TestErrorCodes(t *testing.T) {
+	wsDialer := startTestServer(t)
+	ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ws.Close()
+	for code, msg := range map[string]*internal.BurpTCMessage{
+		internal.ErrorUnknownMessageType: {MessageType: "MADE_UP_MESSAGE"},
+		internal.ErrorRoomNotFound:       {MessageType: "JOIN_ROOM_MESSAGE", Data: "missing" + randSeq(6)},
+		internal.ErrorBadPayload:         {MessageType: "HELLO_MESSAGE", Data: "not json"},
+		internal.ErrorPermissionDenied:   {MessageType: "DELETE_ROOM_MESSAGE", Data: "server"},
+		internal.ErrorBlobNotFound:       {MessageType: "GET_BLOB_MESSAGE", Data: strings.Repeat("0", 64)},
+		internal.ErrorLinkNotFound:       {MessageType: "GET_LINK_MESSAGE", Data: "missing"},
+	} {
+		if err := sendBurpTCMessage(ws, msg); err != nil {
+			t.Fatal(err)
+		}
+		clientError := &internal.ClientError{}
+		if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, ws, "ERROR_MESSAGE").Data), clientError); err != nil {
+			t.Fatal(err)
+		}
+		if clientError.Code != code || clientError.MessageType != msg.MessageType || len(clientError.Reason) == 0 {
+			t.Errorf("%s got error %+v instead of %s", msg.MessageType, clientError, code)
+		}
+	}
+
+	//member lists only come from the server
+	if err := sendBurpTCMessage(ws, &internal.BurpTCMessage{MessageType: "NEW_MEMBER_MESSAGE", Data: "forged"}); err != nil {
+		t.Fatal(err)
+	}
+	if reply := awaitBurpTCMessage(t, ws, "ERROR_MESSAGE"); !strings.Contains(reply.Data, internal.ErrorUnknownMessageType) {
+		t.Errorf("a client sent NEW_MEMBER_MESSAGE and got %s", reply.Data)
+	}
+}
+
+func TestRoomRequests(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "requests" + randSeq(6)
+	joinerName := randSeq(10)
+	var clients []*websocket.Conn
+	for _, username := range []string{randSeq(10), joinerName} {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {username}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	creator, joiner := clients[0], clients[1]
+
+	roomRequest := func(name string, password string) string {
+		requestBytes, _ := json.Marshal(&internal.RoomRequest{Name: name, Password: password})
+		return string(requestBytes)
+	}
+	for _, data := range []string{
+		"{not json",
+		roomRequest("", ""),
+		roomRequest("server", ""),
+		roomRequest("a,b", ""),
+		roomRequest("a:b", ""),
+		roomRequest(" padded", ""),
+		roomRequest(strings.Repeat("r", 65), ""),
+		roomRequest(roomName, strings.Repeat("p", 73)),
+		":password",
+	} {
+		if err := sendBurpTCMessage(creator, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: data}); err != nil {
+			t.Fatal(err)
+		}
+		clientError := &internal.ClientError{}
+		if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, creator, "ERROR_MESSAGE").Data), clientError); err != nil {
+			t.Fatal(err)
+		}
+		if clientError.Code != internal.ErrorBadPayload {
+			t.Errorf("room request %q got %+v", data, clientError)
+		}
+	}
+
+	//passwords may contain colons in either format, the legacy one splits the name off at the first
+	sendAndAwait(t, creator, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomRequest(roomName, "secret:with:colons")}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, creator, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName + ":other"}, "ROOM_EXISTS_MESSAGE")
+	sendAndAwait(t, joiner, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName + ":secret:with"}, "BAD_PASSWORD_MESSAGE")
+	//options only come from JSON requests
+	observerRequest, _ := json.Marshal(&internal.RoomRequest{Name: roomName, Password: "secret:with:colons", Options: internal.RoomOptions{Observer: true}})
+	sendAndAwait(t, joiner, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: string(observerRequest)}, "GOOD_PASSWORD_MESSAGE")
+	awaitRoles(t, creator, map[string]string{joinerName: "observer"})
+
+	//legacy passwords are taken as they are, even when they end like an option
+	legacyRoomName := "legacy" + randSeq(6)
+	sendAndAwait(t, joiner, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: legacyRoomName + ":secret:observer"}, "NEW_MEMBER_MESSAGE")
+	joinRequest, _ := json.Marshal(&internal.RoomRequest{Name: legacyRoomName, Password: "secret:observer"})
+	sendAndAwait(t, creator, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: string(joinRequest)}, "GOOD_PASSWORD_MESSAGE")
+}
+
+func TestShareThenLeave(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "leaving" + randSeq(6)
+	var clients []*websocket.Conn
+	for i := 0; i < 2; i++ {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {randSeq(10)}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	sender, receiver := clients[0], clients[1]
+	sendAndAwait(t, receiver, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, sender, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+
+	//everything shared before leaving reaches the room, even though the room handles it after the hub sees the leave
+	const shared = 50
+	for i := 0; i < shared; i++ {
+		if err := sendBurpTCMessage(sender, &internal.BurpTCMessage{
+			MessageType:         "BURP_MESSAGE",
+			BurpRequestResponse: &internal.BurpRequestResponse{Request: internal.BurpBytes(fmt.Sprintf("GET /%d HTTP/1.1\r\n\r\n", i))},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := sendBurpTCMessage(sender, &internal.BurpTCMessage{MessageType: "LEAVE_ROOM_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < shared; i++ {
+		if request := string(awaitBurpTCMessage(t, receiver, "BURP_MESSAGE").BurpRequestResponse.Request); request != fmt.Sprintf("GET /%d HTTP/1.1\r\n\r\n", i) {
+			t.Fatalf("message %d arrived as %q", i, request)
+		}
+	}
+	//and none of it was refused, which would have been reported before the sender got back to the lobby
+	if err := sendBurpTCMessage(sender, &internal.BurpTCMessage{MessageType: "GET_ROOMS_MESSAGE"}); err != nil {
+		t.Fatal(err)
+	}
+	for {
+		msg, err := readBurpTCMessage(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.MessageType == "ERROR_MESSAGE" {
+			t.Fatalf("a message shared before leaving was refused: %s", msg.Data)
+		}
+		if msg.MessageType == "GET_ROOMS_MESSAGE" {
+			break
+		}
+	}
+}
+
+func TestMuting(t *testing.T) {
+	wsDialer := startTestServer(t)
+	roomName := "mute" + randSeq(6)
+	listenerName, talkerName := randSeq(10), randSeq(10)
+	var clients []*websocket.Conn
+	for _, username := range []string{listenerName, talkerName} {
+		ws, _, err := wsDialer.Dial(fmt.Sprintf("wss://%s:%s", testHost, testPort), http.Header{"Username": {username}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer ws.Close()
+		clients = append(clients, ws)
+	}
+	listener, talker := clients[0], clients[1]
+	sendAndAwait(t, listener, &internal.BurpTCMessage{MessageType: "ADD_ROOM_MESSAGE", Data: roomName}, "NEW_MEMBER_MESSAGE")
+	sendAndAwait(t, talker, &internal.BurpTCMessage{MessageType: "JOIN_ROOM_MESSAGE", Data: roomName}, "ROLES_MESSAGE")
+	talkerClientName := awaitRoles(t, listener, map[string]string{talkerName: "member"})[talkerName]
+
+	share := func(path string) {
+		if err := sendBurpTCMessage(talker, &internal.BurpTCMessage{
+			MessageType:         "BURP_MESSAGE",
+			BurpRequestResponse: &internal.BurpRequestResponse{Request: internal.BurpBytes("GET /" + path + " HTTP/1.1\r\n\r\n")},
+		}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	//unmuting someone who was never muted changes nothing and leaves the room working
+	for _, msg := range []*internal.BurpTCMessage{
+		{MessageType: "UNMUTE_MESSAGE", Data: "nobody#1"},
+		{MessageType: "MUTE_MESSAGE", Data: talkerClientName},
+	} {
+		if err := sendBurpTCMessage(listener, msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sendAndAwait(t, listener, &internal.BurpTCMessage{MessageType: "GET_SCOPE_MESSAGE"}, "GET_SCOPE_MESSAGE")
+	share("muted")
+	sendAndAwait(t, talker, &internal.BurpTCMessage{MessageType: "GET_SCOPE_MESSAGE"}, "GET_SCOPE_MESSAGE")
+	if err := sendBurpTCMessage(listener, &internal.BurpTCMessage{MessageType: "UNMUTE_MESSAGE", Data: "All"}); err != nil {
+		t.Fatal(err)
+	}
+	sendAndAwait(t, listener, &internal.BurpTCMessage{MessageType: "GET_SCOPE_MESSAGE"}, "GET_SCOPE_MESSAGE")
+	share("unmuted")
+	if request := string(awaitBurpTCMessage(t, listener, "BURP_MESSAGE").BurpRequestResponse.Request); request != "GET /unmuted HTTP/1.1\r\n\r\n" {
+		t.Fatalf("muted client was heard: %q", request)
+	}
+}
+
+// reads role announcements until each user has their role, returning the client names of the users
+func awaitRoles(t testing.TB, ws *websocket.Conn, userRoles map[string]string) map[string]string {
+	for {
+		roles := map[string]string{}
+		if err := json.Unmarshal([]byte(awaitBurpTCMessage(t, ws, "ROLES_MESSAGE").Data), &roles); err != nil {
+			t.Fatal(err)
+		}
+		clientNames := map[string]string{}
+		for clientName, role := range roles {
+			if username := clientName[:strings.LastIndex(clientName, "#")]; userRoles[username] == role {
+				clientNames[username] = clientName
+			}
+		}
+		if len(clientNames) == len(userRoles) {
+			return clientNames
+		}
+	}
+}
+
+// uses the wire format the connection negotiated
+func sendBurpTCMessage(ws *websocket.Conn, msg *internal.BurpTCMessage) error {
+	if err := ws.SetWriteDeadline(time.Now().Add(time.Second * 10)); err != nil {
+		return err
+	}
+	if ws.Subprotocol() == internal.WireProtocolV2 {
+		var frame bytes.Buffer
+		encoder := msgpack.NewEncoder(&frame)
+		encoder.SetCustomStructTag("json")
+		if err := encoder.Encode(msg); err != nil {
+			return err
+		}
+		return ws.WriteMessage(websocket.BinaryMessage, frame.Bytes())
+	}
+	jsonBytes, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	return ws.WriteMessage(websocket.TextMessage, []byte(base64.StdEncoding.EncodeToString(jsonBytes)))
+}
+
+func readBurpTCMessage(ws *websocket.Conn) (*internal.BurpTCMessage, error) {
+	if err := ws.SetReadDeadline(time.Now().Add(time.Second * 30)); err != nil {
+		return nil, err
+	}
+	_, message, err := ws.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	msg := internal.NewBurpTCMessage()
+	if ws.Subprotocol() == internal.WireProtocolV2 {
+		decoder := msgpack.NewDecoder(bytes.NewReader(message))
+		decoder.SetCustomStructTag("json")
+		return msg, decoder.Decode(msg)
+	}
+	jsonBytes, err := base64.StdEncoding.DecodeString(string(message))
+	if err != nil {
+		return nil, err
+	}
+	return msg, json.Unmarshal(jsonBytes, msg)
+}
+
+func sendAndAwait(t testing.TB, ws *websocket.Conn, msg *internal.BurpTCMessage, replyType string) {
+	if err := sendBurpTCMessage(ws, msg); err != nil {
+		t.Fatal(err)
+	}
+	awaitBurpTCMessage(t, ws, replyType)
+}
+
+func awaitBurpTCMessage(t testing.TB, ws *websocket.Conn, messageType string) *internal.BurpTCMessage {
+	for {
+		msg, err := readBurpTCMessage(ws)
+		if err != nil {
+			t.Fatalf("waiting for %s: %s", messageType, err)
+		}
+		if msg.MessageType == messageType {
+			return msg
+		}
+	}
+}
+
 var letters = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func randSeq(n int) string {